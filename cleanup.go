@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// abortStale aborts the multipart uploads to keys starting with prefix which
+// were initiated more than olderThan ago, and returns how many it aborted.
+func abortStale(ctx context.Context, svc *s3.Client, bucket, prefix *string, olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	aborted := 0
+	p := s3.NewListMultipartUploadsPaginator(svc, &s3.ListMultipartUploadsInput{
+		Bucket: bucket,
+		Prefix: prefix,
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return aborted, err
+		}
+		for _, u := range page.Uploads {
+			if u.Initiated == nil || !u.Initiated.Before(cutoff) {
+				continue
+			}
+			_, err := svc.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   bucket,
+				Key:      u.Key,
+				UploadId: u.UploadId,
+			})
+			if err != nil {
+				return aborted, err
+			}
+			debugf("Aborted s3://%s/%s - %s, initiated %v", aws.ToString(bucket), aws.ToString(u.Key), aws.ToString(u.UploadId), u.Initiated)
+			aborted++
+		}
+	}
+	return aborted, nil
+}
+
+// listMultipart writes a line for each multipart upload to a key starting
+// with d's key: its s3 URL, UploadId and when it was initiated.
+func listMultipart(ctx context.Context, w io.Writer, svc *s3.Client, d destination) error {
+	p := s3.NewListMultipartUploadsPaginator(svc, &s3.ListMultipartUploadsInput{
+		Bucket: d.bucket,
+		Prefix: d.key,
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, u := range page.Uploads {
+			initiated := "-"
+			if u.Initiated != nil {
+				initiated = u.Initiated.UTC().Format(time.RFC3339)
+			}
+			_, err := fmt.Fprintf(w, "s3://%s/%s\t%s\t%s\n", aws.ToString(d.bucket), aws.ToString(u.Key), aws.ToString(u.UploadId), initiated)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"time"
+)
+
+// compressedMagic are the first bytes of formats which are compressed
+// already, so -compress auto doesn't gzip them again.
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},                // gzip
+	[]byte("PK\x03\x04"),        // zip, and so docx, jar etc.
+	[]byte("\x89PNG\r\n\x1a\n"), // PNG
+	{0xff, 0xd8, 0xff},          // JPEG
+	[]byte("BZh"),               // bzip2
+	[]byte("\xfd7zXZ\x00"),      // xz
+	{0x28, 0xb5, 0x2f, 0xfd},    // zstd
+}
+
+// magicLen is enough of the output to match any of compressedMagic.
+const magicLen = 8
+
+// isCompressed reports whether head starts like a compressed format.
+func isCompressed(head []byte) bool {
+	for _, m := range compressedMagic {
+		if bytes.HasPrefix(head, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipStream returns a reader of r's content compressed with gzip at level,
+// or with adaptiveGzip if adapt is set. An error reading r is returned by the
+// reader once the data before it has been read. Cancelling ctx closes the
+// pipe, so the compressing goroutine stops even if nothing is reading any
+// more.
+func gzipStream(ctx context.Context, r io.Reader, level int, adapt bool) io.Reader {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		if adapt {
+			err = adaptiveGzip(pw, r)
+		} else {
+			zw, _ := gzip.NewWriterLevel(pw, level)
+			_, err = io.Copy(zw, r)
+			if err == nil {
+				err = zw.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			// This fails writes to pw as well as reads of pr. A
+			// read of r which is blocked ends when the command is
+			// killed.
+			pw.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+	return pr
+}
+
+// adaptiveLevel is where -compress-level auto starts, and the highest level
+// it goes back up to.
+const adaptiveLevel = 6
+
+// adaptiveGzip compresses r to w a chunk at a time, for -compress-level auto.
+// After each chunk, it compares the time spent compressing with the time
+// spent waiting for r and for w: if compressing took longer, it's what's
+// holding things up, so the level is lowered; if it took much less, the level
+// is raised again, up to adaptiveLevel. A level can't change within a gzip
+// stream, so each change starts a new gzip member. This is best-effort: the
+// timings are only a rough guide to where the bottleneck is.
+func adaptiveGzip(w io.Writer, r io.Reader) error {
+	tw := &timedWriter{w: w}
+	level := adaptiveLevel
+	zw, _ := gzip.NewWriterLevel(tw, level)
+	buf := make([]byte, 1<<20)
+	for {
+		start := time.Now()
+		n, rerr := io.ReadFull(r, buf)
+		idle := time.Since(start)
+		if n > 0 {
+			tw.blocked = 0
+			start = time.Now()
+			if _, err := zw.Write(buf[:n]); err != nil {
+				return err
+			}
+			busy := time.Since(start) - tw.blocked
+			idle += tw.blocked
+
+			next := level
+			switch {
+			case busy > idle && level > gzip.BestSpeed:
+				next--
+			case busy < idle/2 && level < adaptiveLevel:
+				next++
+			}
+			if next != level {
+				if err := zw.Close(); err != nil {
+					return err
+				}
+				debugf("-compress-level auto: changing from level %d to %d", level, next)
+				level = next
+				zw, _ = gzip.NewWriterLevel(tw, level)
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return zw.Close()
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// timedWriter adds up how long writes to w block.
+type timedWriter struct {
+	w       io.Writer
+	blocked time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	t.blocked += time.Since(start)
+	return n, err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"go.uber.org/goleak"
+)
+
+func TestGzipStreamCancel(t *testing.T) {
+	for _, adapt := range []bool{false, true} {
+		t.Run(map[bool]string{false: "level 6", true: "adaptive"}[adapt], func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+			ctx, cancel := context.WithCancel(context.Background())
+			// Random, so that it doesn't compress to nothing and
+			// keeps the compressing goroutine writing.
+			zr := gzipStream(ctx, rand.Reader, 6, adapt)
+			if _, err := io.ReadFull(zr, make([]byte, 1<<16)); err != nil {
+				t.Fatal(err)
+			}
+			// Stop reading mid-stream, as an upload which failed
+			// does.
+			cancel()
+			if _, err := io.ReadAll(zr); err != context.Canceled {
+				t.Errorf("reading after cancelling: %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// awsSettings are what a config file may set which aren't flags, but go to
+// the SDK: the region and the S3 endpoint. AWS_REGION (or AWS_DEFAULT_REGION)
+// and AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL) take precedence over them.
+type awsSettings struct {
+	region, endpoint string
+}
+
+// applyConfigFile sets the flags in fs which weren't given on the command line
+// from a config file, and returns its awsSettings. The file is a flat YAML
+// mapping of flag names, region or endpoint to values, with repeatable flags
+// given as a list:
+//
+//	region: eu-west-2
+//	sse: aws:kms
+//	part-size: 64MiB
+//	exec-env:
+//	  - TZ=UTC
+func applyConfigFile(fs *flag.FlagSet, filename string) (awsSettings, error) {
+	var settings awsSettings
+	f, err := os.Open(filename)
+	if err != nil {
+		return settings, err
+	}
+	defer f.Close()
+
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var listKey string
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var key, value string
+		if item, ok := strings.CutPrefix(text, "-"); ok && (item == "" || item[0] == ' ') {
+			if listKey == "" {
+				return settings, fmt.Errorf("%s:%d: list item without a setting", filename, line)
+			}
+			key, value = listKey, strings.TrimSpace(item)
+		} else {
+			var ok bool
+			key, value, ok = strings.Cut(text, ":")
+			if !ok {
+				return settings, fmt.Errorf("%s:%d: expected setting: value", filename, line)
+			}
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if key == "region" || key == "endpoint" {
+				listKey = ""
+				v, err := configValue(value)
+				if err != nil {
+					return settings, fmt.Errorf("%s:%d: %s: %v", filename, line, key, err)
+				}
+				if key == "region" {
+					settings.region = v
+				} else {
+					settings.endpoint = v
+				}
+				continue
+			}
+			if fs.Lookup(key) == nil || key == "config" {
+				return settings, fmt.Errorf("%s:%d: unknown setting %q", filename, line, key)
+			}
+			listKey = ""
+			if value == "" {
+				// A list of values follows.
+				listKey = key
+				continue
+			}
+		}
+
+		value, err = configValue(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s:%d: %s: %v", filename, line, key, err)
+		}
+		if given[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return settings, fmt.Errorf("%s:%d: %s: %v", filename, line, key, err)
+		}
+	}
+	return settings, s.Err()
+}
+
+// configValue returns the value of a YAML scalar, which may be quoted or
+// followed by a comment.
+func configValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		return strings.ReplaceAll(v[1:len(v)-1], "''", "'"), nil
+	}
+	v, _, _ = strings.Cut(v, " #")
+	return strings.TrimSpace(v), nil
+}
+
+// effectiveConfig is what -dump-config prints.
+type effectiveConfig struct {
+	Flags        map[string]string `json:"flags"`
+	Region       string            `json:"region"`
+	Endpoint     string            `json:"endpoint,omitempty"`
+	Credentials  credentialsInfo   `json:"credentials"`
+	Destinations []string          `json:"destinations"`
+	Command      string            `json:"command,omitempty"`
+}
+
+// credentialsInfo says where the credentials came from, without the secrets.
+type credentialsInfo struct {
+	Source      string `json:"source,omitempty"`
+	AccessKeyID string `json:"access_key_id,omitempty"`
+	Expires     string `json:"expires,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// dumpConfig writes the settings cmd2s3 would use, with the flags in fs, as
+// JSON. Resolving the credentials may make requests, e.g. to STS with
+// -assume-role.
+func dumpConfig(ctx context.Context, w io.Writer, fs *flag.FlagSet, cfg aws.Config, dests []destination, command string) error {
+	c := effectiveConfig{
+		Flags:    map[string]string{},
+		Region:   cfg.Region,
+		Endpoint: s3Endpoint(cfg),
+		Command:  redactCommand(command),
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		c.Flags[f.Name] = f.Value.String()
+		switch v := f.Value.(type) {
+		case *envList:
+			c.Flags[f.Name] = v.redacted()
+		case *stringList:
+			// -also-command.
+			c.Flags[f.Name] = redactCommand(v.String())
+		}
+		switch f.Name {
+		case "notify-webhook-url":
+			c.Flags[f.Name] = redactURL(f.Value.String())
+		case "pre-command", "post-command":
+			c.Flags[f.Name] = redactCommand(f.Value.String())
+		}
+	})
+
+	if cfg.Credentials == nil {
+		c.Credentials.Error = "no credentials"
+	} else if creds, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		c.Credentials.Error = err.Error()
+	} else {
+		c.Credentials.Source = creds.Source
+		c.Credentials.AccessKeyID = redact(creds.AccessKeyID)
+		if creds.CanExpire {
+			c.Credentials.Expires = creds.Expires.UTC().Format("2006-01-02T15:04:05Z")
+		}
+	}
+
+	for _, d := range dests {
+		c.Destinations = append(c.Destinations, d.String())
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(c)
+}
+
+// resolveCredentials gets the credentials before anything needs them, with
+// a few retries, so that a blip, e.g. of IMDS while it's refreshing them,
+// doesn't fail the first S3 call. They're cached for the calls which follow.
+func resolveCredentials(ctx context.Context, cfg aws.Config) error {
+	if cfg.Credentials == nil {
+		return nil
+	}
+	const attempts = 4
+	delay := 500 * time.Millisecond
+	for i := 1; ; i++ {
+		_, err := cfg.Credentials.Retrieve(ctx)
+		if err == nil || i == attempts || ctx.Err() != nil {
+			return err
+		}
+		warnf("getting AWS credentials failed (attempt %d of %d), retrying in %v: %v", i, attempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// s3Endpoint returns the custom S3 endpoint that's configured, if any.
+func s3Endpoint(cfg aws.Config) string {
+	if e := os.Getenv("AWS_ENDPOINT_URL_S3"); e != "" {
+		return e
+	}
+	return aws.ToString(cfg.BaseEndpoint)
+}
+
+// redactURL keeps only the scheme and host of a URL. The rest may well be a
+// secret, as with a Slack webhook's path, or a token in the query.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return redactCommand(s)
+	}
+	redacted := u.Scheme + "://" + u.Host
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" {
+		redacted += "/<redacted>"
+	}
+	return redacted
+}
+
+// redactCommand hides a shell command, which may have a password in it,
+// e.g. for pg_dump.
+func redactCommand(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// redact keeps only the last 4 characters of s.
+func redact(s string) string {
+	if len(s) <= 4 {
+		return strings.Repeat("*", len(s))
+	}
+	return strings.Repeat("*", len(s)-4) + s[len(s)-4:]
+}
+
+// redacted is like String, but hides the values, as they may well be
+// secrets.
+func (l *envList) redacted() string {
+	vars := make([]string, len(*l))
+	for i, v := range *l {
+		k, _, _ := strings.Cut(v, "=")
+		vars[i] = k + "=<redacted>"
+	}
+	return strings.Join(vars, ",")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"mime"
+	"os"
+	"path"
+	"strings"
+)
+
+// loadMimeTypes reads an Apache-style mime.types file and returns a map from
+// lower case extension (without the dot) to content type. Each line holds a
+// type followed by zero or more extensions; '#' starts a comment.
+func loadMimeTypes(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	byExt := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			byExt[strings.ToLower(ext)] = fields[0]
+		}
+	}
+	return byExt, scanner.Err()
+}
+
+// fallbackTypes are for extensions which the system's table of types may
+// well not have.
+var fallbackTypes = map[string]string{
+	".bz2": "application/x-bzip2",
+	".csv": "text/csv; charset=utf-8",
+	".gz":  "application/gzip",
+	".sql": "application/sql",
+	".tar": "application/x-tar",
+	".tgz": "application/gzip",
+	".xz":  "application/x-xz",
+	".zst": "application/zstd",
+}
+
+// contentTypeFor returns the Content-Type for d. In order, that's the one
+// given for it with -content-type or in its URL; the one for its key's
+// extension, from byExt (-mime-types) or the system's table; the sniffed
+// content, if sniff isn't nil and there is some; or application/octet-stream. For a key such
+// as dump.sql.gz, the extension is .gz, unless gzipped, when that's the
+// Content-Encoding and .sql is the type. Which won is logged with -verbose.
+func contentTypeFor(d destination, byExt map[string]string, gzipped bool, sniff func() string) string {
+	key := *d.key
+	if gzipped {
+		if ext := path.Ext(key); strings.EqualFold(ext, ".gz") {
+			key = strings.TrimSuffix(key, ext)
+		}
+	}
+	ext := strings.ToLower(path.Ext(key))
+
+	var typ, from string
+	switch {
+	case d.contentType != "":
+		typ, from = d.contentType, "-content-type or the URL"
+	case typeByExtension(byExt, key) != "":
+		typ, from = typeByExtension(byExt, key), "-mime-types, for "+ext
+	case ext != "" && mime.TypeByExtension(ext) != "":
+		typ, from = mime.TypeByExtension(ext), "extension "+ext
+	case fallbackTypes[ext] != "":
+		typ, from = fallbackTypes[ext], "extension "+ext
+	default:
+		typ, from = "application/octet-stream", "default"
+		if sniff != nil {
+			if t := sniff(); t != "" {
+				typ, from = t, "content"
+			}
+		}
+	}
+	debugf("%v: Content-Type %s, from the %s", d, typ, from)
+	return typ
+}
+
+// typeByExtension returns the content type for key's extension, or "" if it
+// has none or it isn't in byExt.
+func typeByExtension(byExt map[string]string, key string) string {
+	ext := strings.TrimPrefix(path.Ext(key), ".")
+	if ext == "" {
+		return ""
+	}
+	return byExt[strings.ToLower(ext)]
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxCopyObjectSize is the largest object CopyObject can copy in one go.
+const maxCopyObjectSize = 5 << 30
+
+// copyPartSize is the size of the parts bigger objects are copied in, unless
+// they need bigger ones to fit in the parts S3 allows.
+const copyPartSize = 512 << 20
+
+// copyAPI is the part of *s3.Client which copyParts uses.
+type copyAPI interface {
+	multipartAPI
+	UploadPartCopy(context.Context, *s3.UploadPartCopyInput, ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+}
+
+// runCopy copies src to the object described by dst, whose Body is ignored,
+// and returns the copy's ETag, and its UploadID if it was copied in parts.
+// S3 does the copy with CopyObject where it can; objects which are too big
+// for that are copied with UploadPartCopy, concurrency parts at a time, with
+// SHA256 checksums if checksums is set.
+func runCopy(ctx context.Context, svc *s3.Client, concurrency int, checksums bool, src destination, dst *s3.PutObjectInput, directive types.MetadataDirective) (*manager.UploadOutput, error) {
+	head, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: src.bucket,
+		Key:    src.key,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if aws.ToInt64(head.ContentLength) <= maxCopyObjectSize {
+		out, err := svc.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:                  dst.Bucket,
+			Key:                     dst.Key,
+			CopySource:              aws.String(copySource(src)),
+			MetadataDirective:       directive,
+			ContentType:             dst.ContentType,
+			ContentEncoding:         dst.ContentEncoding,
+			ContentLanguage:         dst.ContentLanguage,
+			Metadata:                dst.Metadata,
+			ServerSideEncryption:    dst.ServerSideEncryption,
+			SSEKMSKeyId:             dst.SSEKMSKeyId,
+			BucketKeyEnabled:        dst.BucketKeyEnabled,
+			WebsiteRedirectLocation: dst.WebsiteRedirectLocation,
+		})
+		if err != nil {
+			return nil, err
+		}
+		res := &manager.UploadOutput{Location: destination{bucket: dst.Bucket, key: dst.Key}.String()}
+		if out.CopyObjectResult != nil {
+			res.ETag = out.CopyObjectResult.ETag
+		}
+		return res, nil
+	}
+	return copyParts(ctx, svc, concurrency, checksums, src, head, dst, directive)
+}
+
+// copyParts copies src, whose HeadObject is head, to dst with a multipart
+// upload of UploadPartCopy parts, as runCopy does for objects too big for
+// CopyObject. The upload is aborted if anything goes wrong.
+func copyParts(ctx context.Context, svc copyAPI, concurrency int, checksums bool, src destination, head *s3.HeadObjectOutput, dst *s3.PutObjectInput, directive types.MetadataDirective) (*manager.UploadOutput, error) {
+	input := createInput(dst, checksums)
+	if directive == types.MetadataDirectiveCopy {
+		input.ContentType = head.ContentType
+		input.ContentEncoding = head.ContentEncoding
+		input.ContentLanguage = head.ContentLanguage
+		input.Metadata = head.Metadata
+	}
+	upload, err := initiateUpload(ctx, svc, input)
+	if err != nil {
+		return nil, err
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	partSize := partSizeFor(size, copyPartSize)
+	nParts := (size + partSize - 1) / partSize
+	completed := make([]types.CompletedPart, nParts)
+	errs := make([]error, nParts)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(concurrency, 1))
+	for i := range nParts {
+		start := i * partSize
+		end := min(start+partSize, size) - 1
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			partNumber := aws.Int32(int32(i + 1))
+			out, err := svc.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+				Bucket:     upload.bucket,
+				Key:        upload.key,
+				UploadId:   upload.uploadID,
+				PartNumber: partNumber,
+				CopySource: aws.String(copySource(src)),
+				// Fail rather than mix parts of two versions,
+				// should src be overwritten during the copy.
+				CopySourceIfMatch: head.ETag,
+				CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			completed[i] = types.CompletedPart{PartNumber: partNumber}
+			if out.CopyPartResult != nil {
+				completed[i].ETag = out.CopyPartResult.ETag
+				completed[i].ChecksumSHA256 = out.CopyPartResult.ChecksumSHA256
+			}
+			debugf("Copied part %d of %d: bytes %d-%d", i+1, nParts, start, end)
+		}()
+	}
+	wg.Wait()
+
+	var etag *string
+	for _, err = range errs {
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		etag, err = completeUpload(ctx, svc, upload, completed)
+	}
+	if err != nil {
+		abortUpload(svc, upload)
+		return nil, err
+	}
+	return &manager.UploadOutput{
+		Location: destination{bucket: dst.Bucket, key: dst.Key}.String(),
+		ETag:     etag,
+		UploadID: aws.ToString(upload.uploadID),
+	}, nil
+}
+
+// copySource returns the URL encoded CopySource of d.
+func copySource(d destination) string {
+	segments := strings.Split(*d.key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	if arn.IsARN(*d.bucket) {
+		// An access point's objects are under object/.
+		return *d.bucket + "/object/" + strings.Join(segments, "/")
+	}
+	return url.PathEscape(*d.bucket) + "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeCopier is a copyAPI which keeps the UploadPartCopy requests it's sent,
+// and fails the one for failPart, if set.
+type fakeCopier struct {
+	*fakeMultipart
+	failPart int32
+
+	copies map[int32]*s3.UploadPartCopyInput // by part number
+}
+
+func (f *fakeCopier) UploadPartCopy(ctx context.Context, in *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := aws.ToInt32(in.PartNumber)
+	f.copies[n] = in
+	if n == f.failPart {
+		return nil, errors.New("part failed")
+	}
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{
+		ETag:           aws.String(fmt.Sprintf(`"etag%d"`, n)),
+		ChecksumSHA256: aws.String(fmt.Sprintf("sum%d", n)),
+	}}, nil
+}
+
+func TestCopyParts(t *testing.T) {
+	const size = 5<<30 + 1
+	src := destination{bucket: aws.String("src"), key: aws.String("dir/a b")}
+	head := &s3.HeadObjectOutput{ContentLength: aws.Int64(size), ETag: aws.String(`"src-etag"`)}
+	dst := &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}
+
+	svc := &fakeCopier{fakeMultipart: &fakeMultipart{algorithm: types.ChecksumAlgorithmSha256}, copies: map[int32]*s3.UploadPartCopyInput{}}
+	out, err := copyParts(context.Background(), svc, 4, true, src, head, dst, types.MetadataDirectiveReplace)
+	if err != nil {
+		t.Fatalf("copyParts: %v", err)
+	}
+	if aws.ToString(out.ETag) != `"etag-1"` || out.UploadID != "upload-id" {
+		t.Errorf("returned ETag %s, UploadID %q; want those of the upload", aws.ToString(out.ETag), out.UploadID)
+	}
+
+	parts := int32((size + copyPartSize - 1) / copyPartSize)
+	if len(svc.copies) != int(parts) {
+		t.Fatalf("%d parts copied, want %d", len(svc.copies), parts)
+	}
+	var next int64
+	for n := int32(1); n <= parts; n++ {
+		in := svc.copies[n]
+		if in == nil {
+			t.Fatalf("part %d wasn't copied", n)
+		}
+		end := min(next+copyPartSize, size) - 1
+		if want := fmt.Sprintf("bytes=%d-%d", next, end); aws.ToString(in.CopySourceRange) != want {
+			t.Errorf("part %d: CopySourceRange %s, want %s", n, aws.ToString(in.CopySourceRange), want)
+		}
+		if got := aws.ToString(in.CopySource); got != "src/dir/a%20b" {
+			t.Errorf("part %d: CopySource %s, want src/dir/a%%20b", n, got)
+		}
+		if aws.ToString(in.CopySourceIfMatch) != `"src-etag"` {
+			t.Errorf("part %d: CopySourceIfMatch %s, want the source's ETag", n, aws.ToString(in.CopySourceIfMatch))
+		}
+		next = end + 1
+	}
+
+	if len(svc.completes) != 1 {
+		t.Fatalf("%d CompleteMultipartUpload requests, want 1", len(svc.completes))
+	}
+	for i, p := range svc.completes[0].MultipartUpload.Parts {
+		n := int32(i + 1)
+		if aws.ToInt32(p.PartNumber) != n || aws.ToString(p.ETag) != fmt.Sprintf(`"etag%d"`, n) || aws.ToString(p.ChecksumSHA256) != fmt.Sprintf("sum%d", n) {
+			t.Errorf("completed part %d is %d, ETag %s, ChecksumSHA256 %s", n, aws.ToInt32(p.PartNumber), aws.ToString(p.ETag), aws.ToString(p.ChecksumSHA256))
+		}
+	}
+	if svc.aborts != 0 {
+		t.Errorf("%d aborts, want none", svc.aborts)
+	}
+}
+
+func TestCopyPartsAborts(t *testing.T) {
+	head := &s3.HeadObjectOutput{ContentLength: aws.Int64(3 * copyPartSize), ETag: aws.String(`"src-etag"`)}
+	svc := &fakeCopier{fakeMultipart: &fakeMultipart{}, copies: map[int32]*s3.UploadPartCopyInput{}, failPart: 2}
+	src := destination{bucket: aws.String("src"), key: aws.String("key")}
+	_, err := copyParts(context.Background(), svc, 1, true, src, head, &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}, types.MetadataDirectiveCopy)
+	if err == nil {
+		t.Fatal("copyParts succeeded, despite a part failing")
+	}
+	if len(svc.completes) != 0 {
+		t.Error("the upload was completed")
+	}
+	if svc.aborts != 1 {
+		t.Errorf("%d aborts, want 1", svc.aborts)
+	}
+}
+
+func TestCopyPartsChecksums(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		checksums bool
+		want      types.ChecksumAlgorithm
+	}{
+		{"with checksums", true, types.ChecksumAlgorithmSha256},
+		{"-disable-content-md5", false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			head := &s3.HeadObjectOutput{ContentLength: aws.Int64(2 * copyPartSize), ETag: aws.String(`"src-etag"`)}
+			svc := &fakeCopier{fakeMultipart: &fakeMultipart{}, copies: map[int32]*s3.UploadPartCopyInput{}}
+			src := destination{bucket: aws.String("src"), key: aws.String("key")}
+			_, err := copyParts(context.Background(), svc, 1, tc.checksums, src, head, &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}, types.MetadataDirectiveReplace)
+			if err != nil {
+				t.Fatalf("copyParts: %v", err)
+			}
+			if got := svc.created.ChecksumAlgorithm; got != tc.want {
+				t.Errorf("ChecksumAlgorithm %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
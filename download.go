@@ -0,0 +1,197 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// runDownload streams the object at d to the standard input of cmd, which
+// must not have been started yet, then waits for cmd to exit. If gunzip is
+// set, the object is decompressed on the way. If spool is set, the object is
+// downloaded to that file first, with downloadToFile. On failure it returns
+// the exit code to use.
+func runDownload(ctx context.Context, svc *s3.Client, d destination, cmd *exec.Cmd, gunzip bool, spool string) (int, error) {
+	var src io.ReadCloser
+	if spool != "" {
+		if code, err := downloadToFile(ctx, svc, d, spool); err != nil {
+			return code, err
+		}
+		f, err := os.Open(spool)
+		if err != nil {
+			return exitError, err
+		}
+		src = f
+	} else {
+		obj, err := svc.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: d.bucket,
+			Key:    d.key,
+		})
+		if err != nil {
+			return exitUploadFail, err
+		}
+		src = obj.Body
+	}
+	defer src.Close()
+
+	var body io.Reader = src
+	var err error
+	if gunzip {
+		body, err = newGunzipReader(body)
+		if err != nil {
+			return exitCorruptGzip, err
+		}
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return exitError, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return exitCommandStart, err
+	}
+
+	_, copyErr := io.Copy(stdin, body)
+	stdin.Close()
+	waitErr := cmd.Wait()
+
+	var gzErr corruptGzipError
+	switch {
+	case errors.As(copyErr, &gzErr):
+		return exitCorruptGzip, copyErr
+	case waitErr != nil:
+		return exitCommandFail, waitErr
+	case errors.Is(copyErr, syscall.EPIPE):
+		// The command exited successfully without reading everything,
+		// e.g. head(1). That's its business.
+		return exitOK, nil
+	case copyErr != nil:
+		return exitUploadFail, copyErr
+	}
+	return exitOK, nil
+}
+
+// downloadToFile downloads the object at d to filename. If reading the
+// object fails part way, it carries on from the last byte received with a
+// ranged GET of the same version, giving up after a few tries in a row which
+// get nowhere. On failure it returns the exit code to use.
+func downloadToFile(ctx context.Context, svc *s3.Client, d destination, filename string) (int, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return exitError, err
+	}
+	defer f.Close()
+
+	var (
+		n, size  int64
+		etag     *string
+		stuck    int
+		maxStuck = 3
+	)
+	for {
+		input := &s3.GetObjectInput{Bucket: d.bucket, Key: d.key, IfMatch: etag}
+		if n > 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", n))
+		}
+		obj, err := svc.GetObject(ctx, input)
+		if err != nil {
+			return exitUploadFail, err
+		}
+		if etag == nil {
+			etag, size = obj.ETag, aws.ToInt64(obj.ContentLength)
+		}
+		body := &errRecorder{Reader: obj.Body}
+		got, err := io.Copy(f, body)
+		obj.Body.Close()
+		n += got
+		if err != nil && body.err == nil {
+			// Writing the file failed.
+			return exitError, err
+		}
+		if err == nil && n < size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return exitUploadFail, err
+		}
+		if got > 0 {
+			stuck = 0
+		} else if stuck++; stuck == maxStuck {
+			return exitUploadFail, fmt.Errorf("gave up after %d tries in a row at byte %d of %d: %w", maxStuck, n, size, err)
+		}
+		warnf("%v: download interrupted at byte %d of %d (%.0f%%), resuming: %v", d, n, size, 100*float64(n)/float64(max(size, 1)), err)
+		select {
+		case <-time.After(time.Duration(stuck) * time.Second):
+		case <-ctx.Done():
+			return exitUploadFail, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return exitError, err
+	}
+	log.Printf("Downloaded %v to %s (%d bytes)", d, filename, n)
+	return exitOK, nil
+}
+
+// corruptGzipError is returned by a gunzipReader when the compressed data is
+// invalid or truncated.
+type corruptGzipError struct{ err error }
+
+func (e corruptGzipError) Error() string { return "corrupt gzip stream: " + e.err.Error() }
+func (e corruptGzipError) Unwrap() error { return e.err }
+
+// gunzipReader decompresses a gzip stream. Errors in the compressed data are
+// reported as corruptGzipError, so they can be told apart from errors reading
+// the underlying stream, which are passed through unchanged.
+type gunzipReader struct {
+	src *errRecorder
+	zr  *gzip.Reader
+}
+
+func newGunzipReader(r io.Reader) (*gunzipReader, error) {
+	src := &errRecorder{Reader: r}
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		if src.err != nil {
+			return nil, err
+		}
+		return nil, corruptGzipError{err}
+	}
+	return &gunzipReader{src, zr}, nil
+}
+
+func (r *gunzipReader) Read(p []byte) (int, error) {
+	n, err := r.zr.Read(p)
+	if err != nil && err != io.EOF && r.src.err == nil {
+		err = corruptGzipError{err}
+	}
+	return n, err
+}
+
+// errRecorder remembers the last error other than io.EOF returned by Read.
+type errRecorder struct {
+	io.Reader
+	err error
+}
+
+func (r *errRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
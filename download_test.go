@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// gzipped returns data, gzipped.
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := io.WriteString(zw, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestGunzipReader(t *testing.T) {
+	data := gzipped(t, "hello, world\n")
+	readErr := errors.New("connection reset")
+	for _, tc := range []struct {
+		name    string
+		r       io.Reader
+		corrupt bool // whether it's a corruptGzipError
+		err     error
+	}{
+		{"valid", bytes.NewReader(data), false, nil},
+		{"truncated", bytes.NewReader(data[:len(data)-4]), true, io.ErrUnexpectedEOF},
+		{"truncated header", bytes.NewReader(data[:5]), true, io.ErrUnexpectedEOF},
+		{"not gzip", bytes.NewReader([]byte("this is not gzip\n")), true, gzip.ErrHeader},
+		{"read error", io.MultiReader(bytes.NewReader(data[:20]), iotest.ErrReader(readErr)), false, readErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			zr, err := newGunzipReader(tc.r)
+			if err == nil {
+				_, err = io.ReadAll(zr)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			var gzErr corruptGzipError
+			if errors.As(err, &gzErr) != tc.corrupt {
+				t.Errorf("%v: corruptGzipError is %t, want %t", err, !tc.corrupt, tc.corrupt)
+			}
+		})
+	}
+}
+
+func TestDownloadTruncatedGzip(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	data := gzipped(t, "hello, world\n")
+	s3.put(t, "bucket", "truncated.gz", data[:len(data)-4])
+	_, err := runCmd2s3(t, "-download", "-gunzip", "s3://bucket/truncated.gz", "cat >/dev/null")
+	if code := exitCode(err); code != exitCorruptGzip {
+		t.Errorf("exit code %d (%v), want %d", code, err, exitCorruptGzip)
+	}
+}
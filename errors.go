@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// errorHints suggest what to do about S3 errors which retrying won't fix.
+var errorHints = map[string]string{
+	"AccessDenied":          "check the credentials' IAM policy and the bucket policy allow this",
+	"InvalidAccessKeyId":    "the access key doesn't exist; check the credentials in use",
+	"SignatureDoesNotMatch": "check the secret key, and that the clock is correct",
+	"ExpiredToken":          "the session credentials have expired; refresh them",
+	"NoSuchBucket":          "check the bucket name in the s3 URL",
+	"NoSuchKey":             "check the key in the s3 URL",
+	"NoSuchUpload":          "the multipart upload was completed or aborted, or the UploadId is wrong",
+	"InvalidArgument":       "S3 rejected one of the flags' values",
+	"KMS.NotFoundException": "check -sse-kms-key-id",
+	"PermanentRedirect":     "the bucket is in another region; set AWS_REGION to match",
+}
+
+// errorCode returns the S3 error code of err, or "" if it doesn't have one.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// describeError returns err with its message followed by its S3 error code
+// and what to do about it, if that's known.
+func describeError(err error) error {
+	return describedError{err}
+}
+
+type describedError struct{ err error }
+
+func (e describedError) Error() string {
+	code := errorCode(e.err)
+	if code == "" {
+		return e.err.Error()
+	}
+	if hint, ok := errorHints[code]; ok {
+		return fmt.Sprintf("%v (error code %s: %s)", e.err, code, hint)
+	}
+	return fmt.Sprintf("%v (error code %s)", e.err, code)
+}
+
+func (e describedError) Unwrap() error { return e.err }
+
+// errorReport is what -error-fd gets on failure.
+type errorReport struct {
+	ExitCode     int    `json:"exit_code"`
+	Message      string `json:"message"`
+	AWSErrorCode string `json:"aws_error_code,omitempty"`
+	Retryable    bool   `json:"retryable"` // whether S3 said the error was transient
+}
+
+// writeErrorReport writes an errorReport of the last error logged as a line
+// of JSON.
+func writeErrorReport(w io.Writer, code int) {
+	r := errorReport{ExitCode: code, Message: redacted(lastError)}
+	if lastErr != nil {
+		r.AWSErrorCode = errorCode(lastErr)
+		r.Retryable = isRetryable(lastErr)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(r)
+}
+
+// newRetryer returns a function making the SDK's standard retryer, except
+// that it waits according to b, and never retries the errors in errorHints, so
+// that denied requests fail straight away instead of after the retry backoff,
+// whatever S3-compatible stores make of them.
+func newRetryer(b backoff) func() aws.Retryer {
+	return func() aws.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = b
+			o.Retryables = append([]retry.IsErrorRetryable{
+				retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+					if _, ok := errorHints[errorCode(err)]; ok {
+						return aws.FalseTernary
+					}
+					return aws.UnknownTernary
+				}),
+			}, o.Retryables...)
+		})
+	}
+}
+
+// backoff is exponential backoff: base before the first retry, doubling
+// for each one after that up to max, less a random fraction of up to jitter.
+type backoff struct {
+	base, max time.Duration
+	jitter    float64
+}
+
+func (b backoff) BackoffDelay(attempt int, _ error) (time.Duration, error) {
+	d := min(float64(b.base)*math.Pow(2, float64(attempt-1)), float64(b.max))
+	d -= d * b.jitter * rand.Float64()
+	return time.Duration(d), nil
+}
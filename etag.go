@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// etagHash works out the ETag S3 gives an object as its data is written to
+// it, for -verify-etag. That's the MD5 of the data for a PutObject. For a
+// multipart upload, it's the MD5 of the parts' MD5s (the binary digests,
+// one after another), then a dash and the number of parts, e.g.
+// "3858f62230ac3c915f300c664312c11f-2". Neither holds with SSE-KMS.
+type etagHash struct {
+	partSize int64
+	part     hash.Hash // of the current part
+	n        int64     // bytes in the current part
+	sums     []byte    // of the parts before it
+}
+
+func newETagHash(partSize int64) *etagHash {
+	return &etagHash{partSize: partSize, part: md5.New()}
+}
+
+func (h *etagHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if h.n == h.partSize {
+			h.sums = h.part.Sum(h.sums)
+			h.part.Reset()
+			h.n = 0
+		}
+		k := min(int64(len(p)), h.partSize-h.n)
+		h.part.Write(p[:k])
+		h.n += k
+		p = p[k:]
+	}
+	return written, nil
+}
+
+// etag returns the ETag, quoted as S3 quotes it, of a multipart upload of
+// what's been written in parts of partSize, or of a PutObject of it.
+func (h *etagHash) etag(multipart bool) string {
+	if !multipart {
+		return fmt.Sprintf(`"%x"`, h.part.Sum(nil))
+	}
+	sums := h.part.Sum(h.sums[:len(h.sums):len(h.sums)])
+	return fmt.Sprintf(`"%x-%d"`, md5.Sum(sums), len(sums)/md5.Size)
+}
+
+// multipartETag returns the ETag, quoted, S3 gives a multipart upload of
+// parts, from their ETags, which are their MD5s. It reports false if one
+// isn't an MD5, as with SSE-KMS.
+func multipartETag(parts []types.CompletedPart) (string, bool) {
+	var sums []byte
+	for _, p := range parts {
+		sum, err := hex.DecodeString(strings.Trim(aws.ToString(p.ETag), `"`))
+		if err != nil || len(sum) != md5.Size {
+			return "", false
+		}
+		sums = append(sums, sum...)
+	}
+	return fmt.Sprintf(`"%x-%d"`, md5.Sum(sums), len(parts)), true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// fanOut returns n readers which each see everything read from r. Reading
+// from r stops if any of them is closed with an error, and that error is then
+// returned by the others.
+func fanOut(r io.Reader, n int) []*io.PipeReader {
+	readers := make([]*io.PipeReader, n)
+	writers := make([]*io.PipeWriter, n)
+	ws := make([]io.Writer, n)
+	for i := range readers {
+		readers[i], writers[i] = io.Pipe()
+		ws[i] = writers[i]
+	}
+	go func() {
+		_, err := io.Copy(io.MultiWriter(ws...), r)
+		for _, w := range writers {
+			w.CloseWithError(err) // nil err means EOF.
+		}
+	}()
+	return readers
+}
+
+// readDestinations reads s3 URLs from filename, one per line. Blank lines and
+// lines starting with '#' are ignored.
+func readDestinations(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
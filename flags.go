@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// envList is a repeatable flag of KEY=VALUE environment variable assignments.
+type envList []string
+
+func (l *envList) String() string { return strings.Join(*l, ",") }
+
+func (l *envList) Set(v string) error {
+	k, _, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not of the form KEY=VALUE", v)
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// stringList is a repeatable flag of strings.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// byteSize is a flag.Value for a number of bytes, optionally with a binary
+// suffix such as KiB, MiB or GiB.
+type byteSize int64
+
+var byteSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	for _, s := range byteSuffixes {
+		if *b != 0 && int64(*b)%s.mult == 0 {
+			return fmt.Sprintf("%d%s", int64(*b)/s.mult, s.suffix)
+		}
+	}
+	return "0"
+}
+
+func (b *byteSize) Set(v string) error {
+	num, mult := v, int64(1)
+	for _, s := range byteSuffixes {
+		if strings.HasSuffix(v, s.suffix) {
+			num, mult = strings.TrimSuffix(v, s.suffix), s.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q is not a size such as 1048576, 512KiB or 64MiB", num)
+	}
+	if n > math.MaxInt64/mult {
+		return fmt.Errorf("%q is too big a size", v)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// exitCodes is a flag.Value for a comma-separated set of exit statuses.
+type exitCodes []int
+
+func (c *exitCodes) String() string {
+	s := make([]string, len(*c))
+	for i, n := range *c {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (c *exitCodes) Set(v string) error {
+	var codes exitCodes
+	for _, f := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 0 || n > 255 {
+			return fmt.Errorf("%q is not a list of exit statuses such as 0,1", v)
+		}
+		codes = append(codes, n)
+	}
+	*c = codes
+	return nil
+}
+
+// contains reports whether code is one of c.
+func (c exitCodes) contains(code int) bool { return slices.Contains(c, code) }
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestByteSizeSet(t *testing.T) {
+	for _, tc := range []struct {
+		v       string
+		want    byteSize
+		wantErr bool
+	}{
+		{"1048576", 1 << 20, false},
+		{"64MiB", 64 << 20, false},
+		{"8388607TiB", 8388607 << 40, false},
+		{"8388608TiB", 0, true},
+		{"9223372036854775807", 1<<63 - 1, false},
+		{"-1KiB", 0, true},
+		{"lots", 0, true},
+	} {
+		var b byteSize
+		err := b.Set(tc.v)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Set(%q): %v, want an error: %t", tc.v, err, tc.wantErr)
+		} else if b != tc.want {
+			t.Errorf("Set(%q) = %d, want %d", tc.v, b, tc.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+)
+
+// likeCommand returns a command to run command like main, with the same
+// shell, environment and directory.
+func likeCommand(ctx context.Context, main *exec.Cmd, command string) *exec.Cmd {
+	// main.Args is the shell, its arguments and the main command.
+	args := append(slices.Clone(main.Args[1:len(main.Args)-1]), command)
+	c := exec.CommandContext(ctx, main.Path, args...)
+	setCommandLine(c)
+	c.Dir = main.Dir
+	c.Env = main.Env
+	c.Stderr = os.Stderr
+	return c
+}
+
+// outputPipe is c.StdoutPipe, unless combine is set, for -combine-output,
+// when c's stdout and stderr are the same pipe. That keeps what the command
+// writes to each in order, but a command usually buffers its stdout when
+// it's not a terminal, and not its stderr, so it may not write them in the
+// order it printed them. started must be called once c has been started.
+func outputPipe(c *exec.Cmd, combine bool) (r io.ReadCloser, started func(), err error) {
+	if !combine {
+		r, err = c.StdoutPipe()
+		return r, func() {}, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Stdout, c.Stderr = pw, pw
+	return pr, func() { pw.Close() }, nil
+}
+
+// runHook runs a -pre-command or -post-command like main, plus extraEnv. Its
+// output goes to stderr, so it isn't mixed up with what cmd2s3 prints.
+func runHook(ctx context.Context, main *exec.Cmd, command string, extraEnv ...string) error {
+	h := likeCommand(ctx, main, command)
+	if len(extraEnv) > 0 {
+		if h.Env == nil {
+			h.Env = os.Environ()
+		}
+		h.Env = append(h.Env, extraEnv...)
+	}
+	h.Stdout = os.Stderr
+	return h.Run()
+}
+
+// lazyReader calls open at the first Read, and reads what it returns, so that
+// an -also-command only starts once the output before it has been read.
+type lazyReader struct {
+	open func() (io.Reader, error)
+	r    io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		r, err := l.open()
+		if err != nil {
+			return 0, err
+		}
+		l.r = r
+	}
+	return l.r.Read(p)
+}
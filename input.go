@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// openInput opens filename for -stdin, with "-" meaning cmd2s3's own
+// standard input. Opening a FIFO blocks until something opens it for
+// writing, so openInput gives up when ctx is done. Reads then return io.EOF
+// once the last writer has closed it.
+func openInput(ctx context.Context, filename string) (io.ReadCloser, error) {
+	if filename == "-" {
+		return os.Stdin, nil
+	}
+	type result struct {
+		f   *os.File
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		// Not O_NONBLOCK: that would make reading a FIFO return
+		// io.EOF straight away if no writer has opened it yet.
+		f, err := os.Open(filename)
+		c <- result{f, err}
+	}()
+	select {
+	case r := <-c:
+		return r.f, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// retryingReader retries a read of r which fails with an error that's worth
+// another go, up to attempts times in a row, for -read-retries. It's for the
+// pipe from the command, or the -stdin input, not the command's exit status.
+type retryingReader struct {
+	io.ReadCloser
+	attempts int
+}
+
+func (r *retryingReader) Read(p []byte) (int, error) {
+	for i := 1; ; i++ {
+		n, err := r.ReadCloser.Read(p)
+		if n > 0 || err == nil || i > r.attempts || !recoverableReadError(err) {
+			return n, err
+		}
+		warnf("reading the command's output failed (attempt %d of %d), retrying: %v", i, r.attempts+1, err)
+		time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+	}
+}
+
+// errTooManyLines is what a lineLimiter's read fails with.
+var errTooManyLines = errors.New("-max-lines exceeded")
+
+// lineLimiter fails reads once more than max newlines have been read
+// through it, for -max-lines. It's a coarse guard against a command stuck
+// in a loop: the read which passes the limit fails as a whole, and a last
+// line without a newline isn't counted.
+type lineLimiter struct {
+	io.Reader
+	max, n int64
+}
+
+func (l *lineLimiter) Read(p []byte) (int, error) {
+	n, err := l.Reader.Read(p)
+	l.n += int64(bytes.Count(p[:n], []byte{'\n'}))
+	if l.n > l.max {
+		return 0, fmt.Errorf("%w: the output has more than %d lines", errTooManyLines, l.max)
+	}
+	return n, err
+}
+
+// recoverableReadError reports whether a read which failed with err may
+// work if tried again.
+func recoverableReadError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, io.ErrNoProgress)
+}
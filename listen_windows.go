@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// listenPrivate listens on the unix socket at path, which only its owner may
+// connect to. Windows has no umask, so the socket is chmodded once it's
+// made.
+func listenPrivate(path string) (*net.UnixListener, error) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// verbose is set by the -verbose flag.
+var verbose bool
+
+// color is whether to colour log messages by level. It's on when they go to
+// a terminal, unless -no-color is given or NO_COLOR is set.
+var color bool
+
+// Log levels. Info is what log.Printf gives.
+const (
+	levelWarn    = "\x1b[33m" // Yellow.
+	levelError   = "\x1b[31m" // Red.
+	levelSuccess = "\x1b[32m" // Green.
+)
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func logLevel(level, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if color {
+		msg = level + msg + "\x1b[0m"
+	}
+	log.Print(msg)
+}
+
+// warnf logs something which may need attention.
+func warnf(format string, v ...interface{}) {
+	logLevel(levelWarn, "warning: "+format, v...)
+}
+
+// lastError is the most recent message logged by errorf, and lastErr the
+// last error in its arguments, if any.
+var (
+	lastError string
+	lastErr   error
+)
+
+// errorf logs a failure.
+func errorf(format string, v ...interface{}) {
+	lastError = fmt.Sprintf(format, v...)
+	lastErr = nil
+	for _, a := range v {
+		if err, ok := a.(error); ok {
+			lastErr = err
+		}
+	}
+	logLevel(levelError, "error: "+format, v...)
+}
+
+// successf logs the final outcome of a successful run.
+func successf(format string, v ...interface{}) {
+	logLevel(levelSuccess, format, v...)
+}
+
+// debugf is log.Printf, but only with -verbose.
+func debugf(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
+
+// logFile is the -log-file, if any.
+var logFile *os.File
+
+// errorFile is the -error-fd, if any.
+var errorFile *os.File
+
+// openFD returns the open file descriptor fd, as given by a flag such as
+// -error-fd.
+func openFD(fd int, name string) (*os.File, error) {
+	f := os.NewFile(uintptr(fd), name)
+	if f == nil {
+		return nil, fmt.Errorf("%d is not a file descriptor", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// onExit, if set, is called by exit with the exit code, and returns the exit
+// code to use instead.
+var onExit func(code int) int
+
+// cleanups are run by exit, after onExit, with the exit code.
+var cleanups []func(code int)
+
+// atExit arranges for f to be called by exit.
+func atExit(f func(code int)) { cleanups = append(cleanups, f) }
+
+// hardExit is called with the exit code when run can't wait any longer to
+// finish in order, e.g. once -deadline's grace has passed, or on a second
+// SIGINT or SIGTERM. main makes it exit; otherwise, e.g. in the tests, it
+// does nothing, and run carries on.
+var hardExit = func(code int) {}
+
+// exit closes the -log-file, if any, and exits with code.
+func exit(code int) {
+	if f := onExit; f != nil {
+		onExit = nil
+		code = f(code)
+	}
+	for _, f := range cleanups {
+		f(code)
+	}
+	if errorFile != nil && code != exitOK {
+		writeErrorReport(errorFile, code)
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	os.Exit(code)
+}
+
+// failure is an error which sets the exit code. If msg is empty, the error
+// has been logged already.
+type failure struct {
+	code int
+	msg  string
+	err  error
+}
+
+func (f *failure) Error() string { return f.msg }
+
+// Unwrap returns the last error in the message's arguments, if any, which is
+// what -error-fd reports the S3 error code of.
+func (f *failure) Unwrap() error { return f.err }
+
+// failf returns a failure with code and a message formatted like errorf's.
+func failf(code int, format string, v ...interface{}) error {
+	f := &failure{code: code, msg: fmt.Sprintf(format, v...)}
+	for _, a := range v {
+		if err, ok := a.(error); ok {
+			f.err = err
+		}
+	}
+	return f
+}
+
+// exitStatus returns a failure with code whose cause has been logged.
+func exitStatus(code int) error {
+	return &failure{code: code}
+}
@@ -1,220 +1,2174 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"maps"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
 )
 
+// Exit codes. Scripts and orchestrators depend on these, so existing values
+// must not be renumbered.
+const (
+	exitOK           = 0 // Command succeeded and the object was uploaded.
+	exitError        = 1 // Any failure not covered below (e.g. bad AWS config).
+	exitUsage        = 2 // Invalid flags or arguments.
+	exitCommandStart = 3 // The shell command could not be started.
+	exitCommandFail  = 4 // The shell command exited non-zero; upload aborted.
+	exitUploadFail   = 5 // The upload to S3 failed.
+	exitVerifyFail   = 6 // The upload succeeded but -verify found a mismatch, or -wait-available gave up.
+	exitTimeout      = 7 // -timeout elapsed before the upload completed.
+	exitCorruptGzip  = 8 // -download -gunzip found the object isn't valid gzip.
+	exitInterrupted  = 9 // SIGINT or SIGTERM stopped the upload.
+)
+
+const usage = `usage: cmd2s3 [flags] s3://bucket/key... 'shell_command [shell_args]...'
+       cmd2s3 -download [flags] s3://bucket/key 'shell_command [shell_args]...'
+       cmd2s3 -copy-from s3://bucket/key [flags] s3://bucket/key
+       cmd2s3 -initiate-only|-complete UploadId [flags] s3://bucket/key
+       cmd2s3 -resume-upload-id UploadId [flags] s3://bucket/key 'shell_command [shell_args]...'
+       cmd2s3 -stdin file|- [flags] s3://bucket/key...
+       cmd2s3 -input-fd N [flags] s3://bucket/key...
+       cmd2s3 -serve socket [flags]
+       cmd2s3 -cleanup-stale duration -cleanup-only [flags] s3://bucket/prefix...
+
+Runs shell_command with sh -c (cmd /C on Windows, or -shell) and uploads its stdout to each s3://bucket/key.
+With -download, streams s3://bucket/key to shell_command's stdin instead.
+
+A destination can have its own content-type, content-language, sse, sse-kms-key-id and
+website-redirect-location as URL query parameters, e.g. s3://bucket/key?sse=aws:kms;
+the flags take precedence where they're set.
+
+Flags:
+`
+
+const exitCodesHelp = `
+Exit codes:
+  0  success
+  1  other error
+  2  bad arguments
+  3  command failed to start
+  4  command exited non-zero
+  5  upload (or download) failed
+  6  upload verification failed, or the object never became available
+  7  timeout
+  8  corrupt gzip stream (-download -gunzip)
+  9  interrupted by SIGINT or SIGTERM
+`
+
 func main() {
-	args := os.Args[1:]
-	if len(args) < 2 {
-		log.Fatal("usage: cmd2s3 s3://bucket/key 'shell_command [shell_args]...'")
+	hardExit = exit
+	code := exitOK
+	if err := run(os.Args[1:], flag.CommandLine); err != nil {
+		code = exitError
+		var f *failure
+		if errors.As(err, &f) {
+			code = f.code
+		}
+		if f == nil || f.msg != "" {
+			errorf("%v", err)
+		}
+	}
+	exit(code)
+}
+
+// run does everything main does but exit, which is left to main: a failure
+// is returned as an error, with the exit code to use if it's a *failure.
+// The flags are defined in fs, and args parsed with it.
+func run(args []string, fs *flag.FlagSet) error {
+	o := newOptions(fs)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+		fmt.Fprint(fs.Output(), exitCodesHelp)
+	}
+	if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		// fs has said what's wrong.
+		return exitStatus(exitUsage)
+	}
+	r := &runner{o: o, fs: fs}
+
+	// Flags given on the command line take precedence over the same
+	// options in URLs, but not those from the config file.
+	r.given = map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { r.given[f.Name] = true })
+
+	// The config file comes first, since it may set any of the flags,
+	// e.g. -error-fd.
+	if o.configFile != "" {
+		var err error
+		if r.fileAWS, err = applyConfigFile(fs, o.configFile); err != nil {
+			return failf(exitUsage, "-config: %v", err)
+		}
+	} else if home, err := os.UserHomeDir(); err == nil {
+		r.fileAWS, err = applyConfigFile(fs, filepath.Join(home, ".cmd2s3.yaml"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return failf(exitUsage, "%v", err)
+		}
+	}
+
+	if o.errorFD >= 0 {
+		f, err := openFD(o.errorFD, "error-fd")
+		if err != nil {
+			return failf(exitUsage, "-error-fd: %v", err)
+		}
+		errorFile = f
+	}
+	if o.inputFD >= 0 {
+		if o.stdinFile != "" {
+			return failf(exitUsage, "-input-fd can't be used with -stdin")
+		}
+		f, err := openFD(o.inputFD, fmt.Sprintf("fd %d", o.inputFD))
+		if err == nil {
+			err = checkReadable(f)
+		}
+		if err != nil {
+			return failf(exitUsage, "-input-fd: %v", err)
+		}
+		r.inputFile = f
+	}
+	r.fromInput = o.stdinFile != "" || r.inputFile != nil
+	r.progressOut = os.Stderr
+	if o.progressFD >= 0 {
+		if !o.progressJSON && o.heartbeat <= 0 {
+			return failf(exitUsage, "-progress-fd requires -progress-json or -heartbeat")
+		}
+		f, err := openFD(o.progressFD, "progress-fd")
+		if err != nil {
+			return failf(exitUsage, "-progress-fd: %v", err)
+		}
+		r.progressOut = f
+	}
+
+	color = !o.noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stderr)
+
+	if o.logFileName != "" {
+		f, err := os.OpenFile(o.logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return failf(exitUsage, "-log-file: %v", err)
+		}
+		logFile = f
+		color = false
+		log.SetOutput(logFile)
+	}
+	if o.redactKey {
+		redactor = &keyRedactor{w: log.Writer()}
+		log.SetOutput(redactor)
+	}
+
+	if err := r.check(fs.Args()); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(startTracing(context.Background()))
+	defer cancel()
+	if o.timeout > 0 && o.serveSocket == "" {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, o.timeout)
+		defer cancelTimeout()
+	}
+	if !r.deadlineAt.IsZero() {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, r.deadlineAt)
+		defer cancelDeadline()
+		// Give the teardown a little while, then stop waiting for it.
+		t := time.AfterFunc(time.Until(r.deadlineAt)+deadlineGrace, func() {
+			errorf("-deadline %s passed %v ago, exiting now", o.deadline, deadlineGrace)
+			hardExit(exitTimeout)
+		})
+		defer t.Stop()
+	}
+
+	if err := r.loadConfig(); err != nil {
+		return err
+	}
+	if o.dumpCfg {
+		if err := dumpConfig(ctx, os.Stdout, fs, r.cfg, r.dests, r.command); err != nil {
+			return failf(exitError, "-dump-config: %v", err)
+		}
+		return nil
+	}
+	if err := r.connect(ctx); err != nil {
+		return err
+	}
+
+	if o.listUploads {
+		return r.listMultipart(ctx)
+	}
+	if o.cleanupStale > 0 {
+		if err := r.cleanupStale(ctx); err != nil || o.cleanupOnly {
+			return err
+		}
+	}
+	switch {
+	case o.untarDir != "":
+		return r.untar(ctx)
+	case o.copyFrom != "":
+		return r.copy(ctx)
+	case o.initiateOnly:
+		return r.initiate(ctx)
+	case o.completeID != "":
+		return r.complete(ctx)
+	}
+
+	var resume *resumePoint
+	if o.resumeID != "" {
+		var err error
+		if resume, err = r.findResumePoint(ctx); err != nil {
+			return err
+		}
+	}
+	if o.serveSocket == "" {
+		r.headBucket(ctx)
+	}
+	cmd := r.newCommand(ctx)
+	if o.serveSocket != "" {
+		return r.serve(ctx, cmd)
+	}
+	if err := r.addHooks(ctx, cmd); err != nil {
+		return err
+	}
+	if o.download {
+		return r.download(ctx, cmd)
+	}
+
+	out, err := r.startOutput(ctx, cmd)
+	switch {
+	case err != nil:
+		return err
+	case out.empty:
+		successf("The output is empty, so nothing was uploaded")
+		return nil
+	case o.resumeUploadID != "":
+		return r.uploadMoreParts(ctx, out)
+	case resume != nil:
+		return r.resume(ctx, out, resume)
+	}
+	return r.upload(ctx, out)
+}
+
+// runner is what run works out from the flags, and shares with the
+// functions for each mode.
+type runner struct {
+	o  *options
+	fs *flag.FlagSet
+
+	command  string
+	dests    []destination
+	src      destination // -copy-from
+	sumsDest destination // -write-sums
+
+	// noCommand is whether no command is run, e.g. with -copy-from, and
+	// fromInput whether the data comes from -stdin or -input-fd instead.
+	noCommand, fromInput bool
+	inputFile            *os.File // -input-fd
+	progressOut          *os.File
+
+	nStreams    int // the destinations the output is streamed to
+	level       int // the gzip level
+	deadlineAt  time.Time
+	shellArgv   []string
+	byExt       map[string]string // -mime-types
+	inferType   bool
+	envMetadata map[string]string
+
+	// given is the flags given on the command line, which take precedence
+	// over the same options in URLs.
+	given map[string]bool
+	// fileAWS is the config file's region and endpoint.
+	fileAWS awsSettings
+
+	cfg      aws.Config
+	svc      *s3.Client
+	uploader *manager.Uploader
+
+	// encoding is the Content-Encoding, once -compress auto has decided.
+	encoding string
+	// sum is the SHA-256 of the output, with -skip-if-unchanged.
+	sum string
+}
+
+// check checks the flags, and the arguments, args, which are the
+// destinations and the command, and works out the rest of r from them.
+func (r *runner) check(args []string) error {
+	o := r.o
+	if o.serveSocket != "" {
+		if len(args) > 0 {
+			return failf(exitUsage, "-serve takes the destinations and commands from the jobs it's sent, not the command line")
+		}
+		// The config file may set any flag, as defaults for the other
+		// modes.
+		for name := range r.given {
+			if !slices.Contains(serveFlags, name) {
+				return failf(exitUsage, "-%s can't be used with -serve", name)
+			}
+		}
+		if o.serveMaxJobs < 1 {
+			return failf(exitUsage, "-serve-max-jobs must be at least 1")
+		}
+		// There's a command, but it comes with each job.
+		args = []string{""}
+	}
+	r.noCommand = o.copyFrom != "" || o.initiateOnly || o.completeID != "" || o.cleanupOnly || o.listUploads || r.fromInput || o.untarDir != ""
+	if r.noCommand {
+		// There's no command, so the last argument is a destination.
+		args = append(args, "")
+	}
+	if len(args) < 2 && !(len(args) == 1 && (o.destinationsFile != "" || o.destFromFirstLine || o.serveSocket != "")) {
+		log.Print("usage: cmd2s3 [flags] s3://bucket/key... 'shell_command [shell_args]...'")
+		return exitStatus(exitUsage)
+	}
+
+	s3urls, command := args[:len(args)-1], args[len(args)-1]
+	r.command = command
+	if !r.noCommand && o.serveSocket == "" && strings.TrimSpace(command) == "" {
+		// sh -c '' succeeds, which would quietly upload an empty object.
+		return failf(exitUsage, "the shell command is empty")
+	}
+	if o.destinationsFile != "" {
+		more, err := readDestinations(o.destinationsFile)
+		if err != nil {
+			return failf(exitUsage, "-destinations-file: %v", err)
+		}
+		s3urls = append(s3urls, more...)
+		if len(s3urls) == 0 {
+			return failf(exitUsage, "-destinations-file: no destinations in %s", o.destinationsFile)
+		}
+	}
+
+	nDests := len(s3urls)
+	if o.destFromFirstLine {
+		if len(s3urls) > 0 {
+			return failf(exitUsage, "-dest-from-first-line can't be used with other destinations")
+		}
+		nDests = 1
+	}
+
+	if o.download && len(s3urls) != 1 {
+		return failf(exitUsage, "-download takes exactly one s3 URL")
+	}
+	if o.untarDir != "" && len(s3urls) != 1 {
+		return failf(exitUsage, "-untar takes exactly one s3 URL")
+	}
+	if o.spoolTo != "" && !o.download {
+		return failf(exitUsage, "-download-to-file requires -download")
+	}
+	if o.gunzip && !o.download && o.untarDir == "" {
+		return failf(exitUsage, "-gunzip requires -download or -untar")
+	}
+	if o.copyFrom != "" && (len(s3urls) != 1 || o.download) {
+		return failf(exitUsage, "-copy-from takes exactly one destination and can't be used with -download")
+	}
+	modes := 0
+	for _, set := range []bool{o.download, o.copyFrom != "", o.initiateOnly, o.resumeUploadID != "", o.resumeID != "", o.completeID != "", o.destFromFirstLine, o.listUploads, o.untarDir != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return failf(exitUsage, "only one of -download, -copy-from, -initiate-only, -upload-id, -resume-upload-id, -complete, -dest-from-first-line, -list-multipart and -untar may be given")
+	}
+	if r.fromInput && (o.download || o.copyFrom != "" || o.initiateOnly || o.completeID != "" || o.cleanupOnly || o.listUploads || o.untarDir != "") {
+		return failf(exitUsage, "-stdin and -input-fd can't be used with -download, -copy-from, -initiate-only, -complete, -cleanup-only, -list-multipart or -untar")
+	}
+	if o.skipUnchanged && (o.download || o.copyFrom != "" || o.initiateOnly || o.resumeUploadID != "" || o.resumeID != "" || o.completeID != "" || o.listUploads || o.untarDir != "") {
+		return failf(exitUsage, "-skip-if-unchanged can only be used for a normal upload")
+	}
+	if o.listUploads && o.cleanupStale > 0 {
+		return failf(exitUsage, "-list-multipart can't be used with -cleanup-stale")
+	}
+	if o.cleanupOnly && (o.cleanupStale <= 0 || modes > 0) {
+		return failf(exitUsage, "-cleanup-only requires -cleanup-stale, and can't be used with other modes")
+	}
+	if o.uploadIDFile != "" && nDests != 1 {
+		return failf(exitUsage, "-upload-id-output-file takes exactly one destination")
+	}
+	if (o.initiateOnly || o.resumeUploadID != "" || o.resumeID != "" || o.completeID != "") && len(s3urls) != 1 {
+		return failf(exitUsage, "-initiate-only, -upload-id, -resume-upload-id and -complete take exactly one destination")
+	}
+
+	switch o.compress {
+	case "", "gzip", "auto":
+	default:
+		return failf(exitUsage, "-compress must be gzip or auto")
+	}
+	if o.compress == "auto" && (o.initiateOnly || o.resumeUploadID != "" || o.resumeID != "") {
+		// The upload's Content-Encoding is set before the output is seen.
+		return failf(exitUsage, "-compress auto can't be used with -initiate-only, -upload-id or -resume-upload-id")
+	}
+	if o.compress != "" && (o.download || o.copyFrom != "" || o.untarDir != "") {
+		return failf(exitUsage, "-compress can't be used with -download, -copy-from or -untar")
+	}
+	r.encoding = o.compress
+	r.level = gzip.DefaultCompression
+	if o.compressLevel != "" {
+		if o.compress == "" {
+			return failf(exitUsage, "-compress-level requires -compress")
+		}
+		if o.compressLevel != "auto" {
+			n, err := strconv.Atoi(o.compressLevel)
+			if err != nil || n < gzip.BestSpeed || n > gzip.BestCompression {
+				return failf(exitUsage, "-compress-level must be from 1 to 9, or auto")
+			}
+			r.level = n
+		}
+	}
+	if o.uncompressedLengthMeta && o.compress == "" {
+		return failf(exitUsage, "-uncompressed-length-metadata requires -compress")
+	}
+
+	switch types.MetadataDirective(o.metadataDirective) {
+	case types.MetadataDirectiveCopy, types.MetadataDirectiveReplace:
+	default:
+		return failf(exitUsage, "-metadata-directive must be COPY or REPLACE")
+	}
+
+	if strings.IndexFunc(o.jobID, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.", r))
+	}) >= 0 {
+		return failf(exitUsage, "-job-id may only contain letters, digits, '-', '_' and '.'")
+	}
+
+	if (o.teeFsync || o.teeFsyncInterval > 0) && o.teeFilename == "" {
+		return failf(exitUsage, "-tee-fsync and -tee-fsync-interval require -tee")
+	}
+
+	if (o.preCommand != "" || o.postCommand != "") && r.noCommand {
+		return failf(exitUsage, "-pre-command and -post-command need a shell command to run around")
+	}
+	if o.readRetries < 0 {
+		return failf(exitUsage, "-read-retries can't be negative")
+	}
+	if o.verifyETag && (o.download || o.copyFrom != "" || o.initiateOnly || o.resumeUploadID != "" || o.resumeID != "" || o.completeID != "" || o.cleanupOnly || o.listUploads || o.untarDir != "") {
+		return failf(exitUsage, "-verify-etag can only be used for a normal upload")
+	}
+	if o.uniqueSuffix && (o.download || o.untarDir != "" || o.cleanupOnly || o.listUploads || o.completeID != "" || o.resumeUploadID != "") {
+		return failf(exitUsage, "-unique-suffix only makes sense when uploading a new object")
+	}
+	if o.combineOutput && (r.noCommand || o.download) {
+		return failf(exitUsage, "-combine-output needs a shell command whose output is uploaded")
+	}
+	if o.deadline != "" {
+		t, err := time.Parse(time.RFC3339, o.deadline)
+		if err != nil {
+			return failf(exitUsage, "-deadline: %v", err)
+		}
+		if !t.After(time.Now()) {
+			return failf(exitUsage, "-deadline %s has passed already", o.deadline)
+		}
+		r.deadlineAt = t
+	}
+	if o.maxLines < 0 {
+		return failf(exitUsage, "-max-lines can't be negative")
+	}
+	if o.maxLines > 0 && ((r.noCommand && !r.fromInput) || o.download) {
+		return failf(exitUsage, "-max-lines needs output to upload, from a shell command, -stdin or -input-fd")
+	}
+	if len(o.alsoCommands) > 0 && (r.noCommand || o.download) {
+		return failf(exitUsage, "-also-command needs a shell command to follow, and can't be used with -download")
+	}
+	if o.postAlways && o.postCommand == "" {
+		return failf(exitUsage, "-post-always requires -post-command")
+	}
+
+	if o.retryBaseDelay <= 0 || o.retryMaxDelay < o.retryBaseDelay {
+		return failf(exitUsage, "-retry-base-delay must be positive, and no more than -retry-max-delay")
+	}
+	if o.retryJitter < 0 || o.retryJitter > 1 {
+		return failf(exitUsage, "-retry-jitter must be between 0 and 1")
+	}
+
+	if o.stsRegional && o.assumeRole == "" {
+		return failf(exitUsage, "-sts-regional-endpoint requires -assume-role")
+	}
+
+	// explicit is the flags which are set, on the command line or in the
+	// config file.
+	explicit := map[string]bool{}
+	r.fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if o.profilePreset != "" {
+		p, ok := presets[o.profilePreset]
+		if !ok {
+			return failf(exitUsage, "-profile-preset must be one of %s", strings.Join(presetNames, ", "))
+		}
+		if !explicit["part-size"] {
+			o.partSize = byteSize(p.partSize)
+		}
+		if !explicit["concurrency"] {
+			o.concurrency = p.concurrency
+		}
+	}
+
+	if o.maxParts < 1 || int64(o.maxParts) > maxUploadParts {
+		return failf(exitUsage, "-max-upload-parts must be between 1 and %d", maxUploadParts)
+	}
+	if o.concurrency < 1 || o.totalConcurrency < 0 || o.maxFiles < 1 {
+		return failf(exitUsage, "-concurrency and -max-concurrent-files must be at least 1 and -total-concurrency can't be negative")
+	}
+	r.nStreams = min(nDests, o.maxFiles)
+	if o.totalConcurrency > 0 {
+		if o.totalConcurrency < r.nStreams {
+			return failf(exitUsage, "-total-concurrency must be at least the number of destinations (%d)", r.nStreams)
+		}
+		o.concurrency = o.totalConcurrency / r.nStreams
+	}
+
+	if o.expectedSize > 0 {
+		if !explicit["part-size"] {
+			suits := byteSize(partSizeForExpected(int64(o.expectedSize)))
+			if o.profilePreset == "" {
+				o.partSize = suits
+			} else {
+				// The preset's part size, unless that's too small.
+				o.partSize = max(o.partSize, suits)
+			}
+			log.Printf("Using %v parts for an expected %v", &o.partSize, &o.expectedSize)
+		}
+	}
+
+	if int64(o.partSize) < manager.MinUploadPartSize || o.partSize > maxPartSize {
+		return failf(exitUsage, "-part-size must be between 5MiB and 5GiB, as S3 requires of every part but the last")
+	}
+	if uploading := (!r.noCommand || r.fromInput) && !o.download; uploading {
+		buffered := byteSize(int64(r.nStreams) * int64(o.concurrency+1) * int64(o.partSize))
+		if avail := byteSize(availableMemory() >> 20 << 20); avail > 0 && buffered > avail {
+			warnf("-part-size %v with -concurrency %d may buffer up to %v for %d destination(s), but only %v of memory is available",
+				&o.partSize, o.concurrency, &buffered, r.nStreams, &avail)
+		}
+	}
+
+	if o.printURLFormat != "" && !slices.Contains(urlFormats, o.printURLFormat) {
+		return failf(exitUsage, "-print-url-format must be one of %s", strings.Join(urlFormats, ", "))
+	}
+	if o.presignExpiry < 0 || o.presignExpiry > maxPresignExpiry {
+		return failf(exitUsage, "-presign-expiry must be between 0 and %v", maxPresignExpiry)
+	}
+
+	if o.websiteRedirect != "" {
+		if err := checkRedirectLocation(o.websiteRedirect); err != nil {
+			return failf(exitUsage, "-website-redirect-location: %v", err)
+		}
+	}
+
+	if o.sseKMSKeyAlias != "" {
+		if o.sseKMSKeyID != "" {
+			return failf(exitUsage, "give -sse-kms-key-id or -sse-kms-key-alias, not both")
+		}
+		if err := checkKMSAlias(o.sseKMSKeyAlias); err != nil {
+			return failf(exitUsage, "-sse-kms-key-alias: %v", err)
+		}
+		// S3 takes an alias as the key ID.
+		r.fs.Set("sse-kms-key-id", o.sseKMSKeyAlias)
+		r.given["sse-kms-key-id"] = r.given["sse-kms-key-alias"]
+	}
+
+	switch types.ServerSideEncryption(o.sse) {
+	case types.ServerSideEncryptionAes256:
+		if o.sseKMSKeyID != "" || o.bucketKeyEnabled {
+			return failf(exitUsage, "-sse-kms-key-id, -sse-kms-key-alias and -bucket-key-enabled require -sse aws:kms")
+		}
+	case types.ServerSideEncryptionAwsKms:
+	default:
+		return failf(exitUsage, "unsupported -sse %q, want AES256 or aws:kms", o.sse)
+	}
+
+	keyVars := newKeyData(command, time.Now(), randSuffix(o.randSeed))
+	r.dests = make([]destination, len(s3urls))
+	for i, s3url := range s3urls {
+		bucket, key, options, err := parseS3URL(s3url)
+		if err != nil {
+			return failf(exitUsage, "invalid URL: %v", err)
+		}
+		given := *key
+		if o.templateKeys {
+			*key, err = expandKey(*key, keyVars)
+			if err != nil {
+				return failf(exitUsage, "-template-keys: %v", err)
+			}
+		}
+		if o.uniqueSuffix {
+			*key += "-" + keyVars.Rand
+		}
+		if redactor != nil {
+			redactor.add(*key)
+		}
+		if o.strictKeys {
+			if err := checkKey(*key); err != nil {
+				return failf(exitUsage, "-strict-keys: %s: %v", s3url, err)
+			}
+		}
+		r.dests[i], err = r.newDestination(bucket, key, options)
+		if err != nil {
+			return failf(exitUsage, "%s: %v", s3url, err)
+		}
+		if *key != given {
+			log.Printf("Uploading to %v", r.dests[i])
+		}
+	}
+
+	if o.writeSums != "" {
+		if (r.noCommand && !r.fromInput) || o.download {
+			return failf(exitUsage, "-write-sums needs output to upload, from a shell command, -stdin or -input-fd")
+		}
+		bucket, key, options, err := parseS3URL(o.writeSums)
+		if err != nil {
+			return failf(exitUsage, "-write-sums: invalid URL: %v", err)
+		}
+		r.sumsDest, err = r.newDestination(bucket, key, options)
+		if err != nil {
+			return failf(exitUsage, "-write-sums: %v", err)
+		}
+		if r.sumsDest.contentType == "" {
+			r.sumsDest.contentType = "text/plain; charset=utf-8"
+		}
+		if redactor != nil {
+			redactor.add(*key)
+		}
+	}
+
+	if o.copyFrom != "" {
+		bucket, key, options, err := parseS3URL(o.copyFrom)
+		if err != nil {
+			return failf(exitUsage, "-copy-from: invalid URL: %v", err)
+		}
+		if len(options) > 0 {
+			return failf(exitUsage, "-copy-from: options only apply to destinations, not the source URL")
+		}
+		r.src = destination{bucket: bucket, key: key}
+		if redactor != nil {
+			redactor.add(*key)
+		}
+	}
+
+	r.shellArgv = strings.Fields(o.shell)
+	if !r.noCommand {
+		if len(r.shellArgv) == 0 {
+			return failf(exitUsage, "-shell is empty")
+		}
+		if _, err := exec.LookPath(r.shellArgv[0]); err != nil {
+			return failf(exitCommandStart, "-shell: %v", err)
+		}
+	}
+
+	if o.workdir != "" {
+		fi, err := os.Stat(o.workdir)
+		if err == nil && !fi.IsDir() {
+			err = fmt.Errorf("%s is not a directory", o.workdir)
+		}
+		if err != nil {
+			return failf(exitUsage, "-workdir: %v", err)
+		}
+	}
+
+	if o.mimeTypes != "" {
+		var err error
+		r.byExt, err = loadMimeTypes(o.mimeTypes)
+		if err != nil {
+			return failf(exitUsage, "-mime-types: %v", err)
+		}
+	}
+	r.inferType = o.autoType || o.mimeTypes != ""
+	if r.inferType && r.noCommand && !r.fromInput {
+		// There's no output to sniff, e.g. with -copy-from.
+		for i := range r.dests {
+			r.dests[i].contentType = contentTypeFor(r.dests[i], r.byExt, false, nil)
+		}
+	}
+
+	if o.metadataFromEnv != "" {
+		r.envMetadata = map[string]string{}
+		for _, name := range strings.Split(o.metadataFromEnv, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			v, ok := commandEnv(name, o.execEnv, o.execClearEnv)
+			if !ok {
+				warnf("-metadata-from-env: %s isn't set", name)
+				continue
+			}
+			r.envMetadata[name] = v
+		}
+	}
+	return nil
+}
+
+// timedOut says why ctx is done, if that's because of -timeout or
+// -deadline.
+func (r *runner) timedOut() string {
+	if !r.deadlineAt.IsZero() && !time.Now().Before(r.deadlineAt) {
+		return "reached -deadline " + r.o.deadline
+	}
+	return fmt.Sprintf("timed out after %v", r.o.timeout)
+}
+
+// loadConfig loads the AWS config, as the flags say to.
+func (r *runner) loadConfig() error {
+	o := r.o
+	httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.MaxIdleConns = o.maxIdleConns
+		tr.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+		tr.MaxConnsPerHost = o.maxConnsPerHost
+		tr.IdleConnTimeout = o.idleConnTimeout
+	})
+	cfgOpts := []func(*config.LoadOptions) error{
+		config.WithRetryer(newRetryer(backoff{base: o.retryBaseDelay, max: o.retryMaxDelay, jitter: o.retryJitter})),
+		config.WithHTTPClient(httpClient),
+	}
+	if o.disableContentMD5 {
+		cfgOpts = append(cfgOpts,
+			config.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
+			config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+		)
+	}
+
+	if o.dualStack {
+		cfgOpts = append(cfgOpts, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+
+	// The config file's region and endpoint are only defaults for the
+	// environment's.
+	if s := r.fileAWS.region; s != "" && os.Getenv("AWS_REGION") == "" && os.Getenv("AWS_DEFAULT_REGION") == "" {
+		cfgOpts = append(cfgOpts, config.WithRegion(s))
+	}
+	if s := r.fileAWS.endpoint; s != "" && os.Getenv("AWS_ENDPOINT_URL_S3") == "" && os.Getenv("AWS_ENDPOINT_URL") == "" {
+		cfgOpts = append(cfgOpts, config.WithBaseEndpoint(s))
+	}
+
+	if o.jobID != "" {
+		cfgOpts = append(cfgOpts, config.WithAPIOptions([]func(*middleware.Stack) error{
+			awsmiddleware.AddUserAgentKeyValue("cmd2s3-job", o.jobID),
+		}))
+	}
+
+	if verbose {
+		cfgOpts = append(cfgOpts, config.WithAPIOptions([]func(*middleware.Stack) error{logRetries}))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), cfgOpts...)
+	if err != nil {
+		return failf(exitError, "s4cat: unable to load config: %v", err)
+	}
+	if o.dualStack && s3Endpoint(cfg) != "" {
+		// The SDK refuses to combine these, but only once it makes a request.
+		return failf(exitUsage, "-dualstack can't be used with a custom endpoint")
+	}
+	if o.printURLFormat == "console" && s3Endpoint(cfg) != "" {
+		return failf(exitUsage, "-print-url-format console can't be used with a custom endpoint")
+	}
+	if o.assumeRole != "" {
+		if o.stsRegional && (cfg.Region == "" || cfg.Region == "aws-global") {
+			return failf(exitUsage, "-sts-regional-endpoint: set a region, e.g. with AWS_REGION")
+		}
+		// The SDK uses the regional STS endpoint unless the region is
+		// aws-global, which is ruled out above.
+		stsSvc := sts.NewFromConfig(cfg)
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsSvc, o.assumeRole))
+	}
+	r.cfg = cfg
+	return nil
+}
+
+// headBucket makes a first S3 call, HeadBucket on the first destination's
+// bucket, before the command is started, and retries it while it fails
+// transiently, so that a blip then, e.g. of IMDS, doesn't cost the command's
+// work. Any other failure, e.g. for want of s3:ListBucket, is left for the
+// calls which follow to report.
+func (r *runner) headBucket(ctx context.Context) {
+	d := r.dests[0]
+	err := retryControl(ctx, "HeadBucket", func() error {
+		_, err := r.svc.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: d.bucket})
+		return err
+	})
+	if err != nil {
+		debugf("%v: HeadBucket: %s", d, describeError(err))
+	}
+}
+
+// connect gets the credentials, and makes the S3 client and uploader. It
+// also sets up the notifications, since they're sent whatever happens next.
+func (r *runner) connect(ctx context.Context) error {
+	o := r.o
+	if err := resolveCredentials(ctx, r.cfg); err != nil {
+		return failf(exitUploadFail, "unable to get AWS credentials: %v", err)
+	}
+	if o.notifySNS != "" || o.notifyURL != "" {
+		nt := &notifier{topicARN: o.notifySNS, webhookURL: o.notifyURL}
+		if o.notifySNS != "" {
+			nt.sns = sns.NewFromConfig(r.cfg)
+		}
+		onExit = func(code int) int {
+			n := notification{Result: "success", ExitCode: code, JobID: o.jobID}
+			if code != exitOK {
+				n.Result, n.Error = "failure", redacted(lastError)
+			}
+			for _, d := range r.dests {
+				n.Destinations = append(n.Destinations, redacted(d.String()))
+			}
+			if err := nt.send(n); err != nil {
+				warnf("notification failed: %v", err)
+				if o.strictNotify && code == exitOK {
+					code = exitError
+				}
+			}
+			return code
+		}
+	}
+	r.svc = s3.NewFromConfig(r.cfg, func(so *s3.Options) {
+		// Send requests for an access point to its region.
+		so.UseARNRegion = o.serveSocket != "" || r.src.bucket != nil && arn.IsARN(*r.src.bucket)
+		for _, d := range r.dests {
+			so.UseARNRegion = so.UseARNRegion || arn.IsARN(*d.bucket)
+		}
+		if o.uploadIDFile != "" {
+			so.APIOptions = append(so.APIOptions, writeUploadID(o.uploadIDFile, func() multipartAPI { return r.svc }))
+		}
+		if o.logUploadIDs {
+			so.APIOptions = append(so.APIOptions, logUploadID)
+		}
+		if o.rampUpWindow > 0 {
+			so.APIOptions = append(so.APIOptions, newRampUp(o.concurrency*r.nStreams, o.rampUpWindow).middleware)
+		}
+	})
+
+	r.uploader = manager.NewUploader(r.svc, func(u *manager.Uploader) {
+		// 128MiB per part by default (s3manager buffers these)
+		u.PartSize = int64(o.partSize)
+		// 4 streams to s3 by default. s3manager buffers one more part
+		// than that, so with 1 destination max memory usage is 640MiB.
+		u.Concurrency = o.concurrency
+		u.MaxUploadParts = int32(o.maxParts)
+		if !o.disableContentMD5 {
+			u.ClientOptions = append(u.ClientOptions, func(so *s3.Options) {
+				so.APIOptions = append(so.APIOptions, putObjectMD5)
+			})
+		}
+		if o.disableContentMD5 {
+			u.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		}
+	})
+	return nil
+}
+
+// newDestination makes the destination for bucket and key, with the
+// options from its URL where the flags don't say otherwise.
+func (r *runner) newDestination(bucket, key *string, options map[string]string) (destination, error) {
+	o := r.o
+	d := destination{
+		bucket:          bucket,
+		key:             key,
+		contentType:     o.contentType,
+		contentLanguage: o.contentLanguage,
+		sse:             o.sse,
+		sseKMSKeyID:     o.sseKMSKeyID,
+		websiteRedirect: o.websiteRedirect,
+	}
+	if len(options) == 0 {
+		return d, nil
+	}
+	for name, v := range options {
+		if r.given[name] {
+			continue
+		}
+		switch name {
+		case "content-type":
+			d.contentType = v
+		case "content-language":
+			d.contentLanguage = v
+		case "sse":
+			d.sse = v
+		case "sse-kms-key-id":
+			d.sseKMSKeyID = v
+		case "website-redirect-location":
+			d.websiteRedirect = v
+		}
+	}
+	return d, d.checkOptions(o.bucketKeyEnabled)
+}
+
+// newInput makes the PutObjectInput to upload body to d.
+func (r *runner) newInput(d destination, body io.Reader) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:               d.bucket,
+		Key:                  d.key,
+		ServerSideEncryption: types.ServerSideEncryption(d.sse),
+		Body:                 body,
+	}
+	if d.contentType != "" {
+		input.ContentType = aws.String(d.contentType)
+	}
+	if d.sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(d.sseKMSKeyID)
+	}
+	if r.o.bucketKeyEnabled {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+	if d.websiteRedirect != "" {
+		input.WebsiteRedirectLocation = aws.String(d.websiteRedirect)
+	}
+	if r.encoding != "" {
+		input.ContentEncoding = aws.String(r.encoding)
+	}
+	if d.contentLanguage != "" {
+		input.ContentLanguage = aws.String(d.contentLanguage)
+	}
+	if len(r.envMetadata) > 0 {
+		input.Metadata = maps.Clone(r.envMetadata)
+	}
+	if r.sum != "" {
+		if input.Metadata == nil {
+			input.Metadata = map[string]string{}
+		}
+		input.Metadata[sha256MetaKey] = r.sum
+	}
+	return input
+}
+
+// newCreateInput makes the CreateMultipartUploadInput to upload to d.
+func (r *runner) newCreateInput(d destination) *s3.CreateMultipartUploadInput {
+	return createInput(r.newInput(d, nil), !r.o.disableContentMD5)
+}
+
+// listMultipart is -list-multipart.
+func (r *runner) listMultipart(ctx context.Context) error {
+	for _, d := range r.dests {
+		if err := listMultipart(ctx, os.Stdout, r.svc, d); err != nil {
+			return failf(exitUploadFail, "%v: -list-multipart: %s", d, describeError(err))
+		}
+	}
+	return nil
+}
+
+// cleanupStale is -cleanup-stale.
+func (r *runner) cleanupStale(ctx context.Context) error {
+	for _, d := range r.dests {
+		n, err := abortStale(ctx, r.svc, d.bucket, d.key, r.o.cleanupStale)
+		if err != nil {
+			return failf(exitUploadFail, "%v: -cleanup-stale: %s", d, describeError(err))
+		}
+		log.Printf("Aborted %d stale multipart uploads under %v", n, d)
+	}
+	return nil
+}
+
+// untar is -untar.
+func (r *runner) untar(ctx context.Context) error {
+	n, code, err := runUntar(ctx, r.svc, r.dests[0], r.o.untarDir, r.o.gunzip)
+	if err != nil {
+		return failf(code, "%v: -untar: %s", r.dests[0], describeError(err))
+	}
+	successf("Extracted %d entries from %v into %s", n, r.dests[0], r.o.untarDir)
+	return nil
+}
+
+// copy is -copy-from.
+func (r *runner) copy(ctx context.Context) error {
+	_, err := runCopy(ctx, r.svc, r.o.concurrency, !r.o.disableContentMD5, r.src, r.newInput(r.dests[0], nil), types.MetadataDirective(r.o.metadataDirective))
+	if err != nil {
+		return failf(exitUploadFail, "%v: %s", r.dests[0], describeError(err))
+	}
+	successf("Object copied: %v -> %v", r.src, r.dests[0])
+	return nil
+}
+
+// initiate is -initiate-only.
+func (r *runner) initiate(ctx context.Context) error {
+	upload, err := initiateUpload(ctx, r.svc, r.newCreateInput(r.dests[0]))
+	if err != nil {
+		return failf(exitUploadFail, "%v: %s", r.dests[0], describeError(err))
+	}
+	fmt.Println(*upload.uploadID)
+	return nil
+}
+
+// complete is -complete.
+func (r *runner) complete(ctx context.Context) error {
+	d := r.dests[0]
+	upload := &multipartUpload{bucket: d.bucket, key: d.key, uploadID: aws.String(r.o.completeID)}
+	parts, err := listParts(ctx, r.svc, upload)
+	if err == nil && len(parts) == 0 {
+		err = errors.New("no parts have been uploaded")
+	}
+	if err != nil {
+		return failf(exitUploadFail, "%v: %s", d, describeError(err))
+	}
+	completed := make([]types.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = types.CompletedPart{ETag: p.ETag, PartNumber: p.PartNumber, ChecksumSHA256: p.ChecksumSHA256}
+	}
+	_, err = completeUpload(ctx, r.svc, upload, completed)
+	if err != nil {
+		return failf(exitUploadFail, "%v: %s", d, describeError(err))
+	}
+	successf("Object uploaded: %v - %v (%d parts)", d, r.o.completeID, len(parts))
+	return nil
+}
+
+// resumePoint is where -resume-upload-id carries on from: the upload, and
+// the parts of it which are kept.
+type resumePoint struct {
+	upload *multipartUpload
+	parts  []types.CompletedPart
+}
+
+// findResumePoint works out where -resume-upload-id carries on from, and
+// tells the command, through its environment.
+func (r *runner) findResumePoint(ctx context.Context) (*resumePoint, error) {
+	o, d := r.o, r.dests[0]
+	rp := &resumePoint{upload: &multipartUpload{bucket: d.bucket, key: d.key, uploadID: aws.String(o.resumeID)}}
+	parts, err := listParts(ctx, r.svc, rp.upload)
+	if err != nil {
+		return nil, failf(exitUploadFail, "%v: %s", d, describeError(err))
+	}
+	from := o.resumeFrom
+	if from == 0 {
+		from = len(parts) + 1
+	}
+	if from < 1 || from > len(parts)+1 {
+		return nil, failf(exitUsage, "-resume-from-part must be between 1 and %d", len(parts)+1)
+	}
+	var offset int64
+	for _, p := range parts[:from-1] {
+		if size := aws.ToInt64(p.Size); size < manager.MinUploadPartSize {
+			return nil, failf(exitUploadFail, "%v: part %d is only %d bytes, so it must be the last part; use -resume-from-part %d",
+				d, aws.ToInt32(p.PartNumber), size, aws.ToInt32(p.PartNumber))
+		}
+		offset += aws.ToInt64(p.Size)
+		rp.parts = append(rp.parts, types.CompletedPart{ETag: p.ETag, PartNumber: p.PartNumber, ChecksumSHA256: p.ChecksumSHA256})
+	}
+	o.execEnv = append(o.execEnv, fmt.Sprintf("CMD2S3_RESUME_OFFSET=%d", offset), fmt.Sprintf("CMD2S3_RESUME_PART=%d", from))
+	log.Printf("Resuming %v - %v from part %d, %d bytes in", d, o.resumeID, from, offset)
+	return rp, nil
+}
+
+// newCommand makes the command, as the flags say to run it.
+func (r *runner) newCommand(ctx context.Context) *exec.Cmd {
+	o := r.o
+	var cmd *exec.Cmd
+	if len(r.shellArgv) > 0 {
+		cmd = exec.CommandContext(ctx, r.shellArgv[0], append(r.shellArgv[1:], r.command)...)
+		setCommandLine(cmd)
+	} else {
+		// There's no command to run; cmd is never started.
+		cmd = exec.CommandContext(ctx, "")
+	}
+	cmd.Stderr = os.Stderr
+	cmd.Dir = o.workdir
+	if o.execClearEnv || len(o.execEnv) > 0 {
+		env := []string{}
+		if !o.execClearEnv {
+			env = os.Environ()
+		}
+		// Later entries take precedence, so -exec-env overrides.
+		cmd.Env = append(env, o.execEnv...)
+	}
+	if o.killTimeout > 0 {
+		stopGently(cmd, o.killTimeout)
+	}
+	return cmd
+}
+
+// serve is -serve. Each job's command is run like cmd.
+func (r *runner) serve(ctx context.Context, cmd *exec.Cmd) error {
+	o := r.o
+	l, err := listenUnix(o.serveSocket)
+	if err != nil {
+		return failf(exitError, "-serve: %v", err)
+	}
+	atExit(func(int) { l.Close() })
+	s := &server{
+		l:           l,
+		conns:       map[net.Conn]bool{},
+		slots:       make(chan struct{}, o.serveMaxJobs),
+		cmd:         cmd,
+		timeout:     o.timeout,
+		killTimeout: o.killTimeout,
+		newDest: func(s3url string) (destination, error) {
+			bucket, key, options, err := parseS3URL(s3url)
+			if err != nil {
+				return destination{}, fmt.Errorf("invalid URL: %v", err)
+			}
+			if redactor != nil {
+				redactor.add(*key)
+			}
+			if o.strictKeys {
+				if err := checkKey(*key); err != nil {
+					return destination{}, fmt.Errorf("-strict-keys: %s: %v", s3url, err)
+				}
+			}
+			d, err := r.newDestination(bucket, key, options)
+			if err != nil {
+				return destination{}, fmt.Errorf("%s: %v", s3url, err)
+			}
+			if r.inferType {
+				d.contentType = contentTypeFor(d, r.byExt, false, nil)
+			}
+			return d, nil
+		},
+		upload: func(ctx context.Context, d destination, body io.Reader) (*manager.UploadOutput, error) {
+			return r.uploader.Upload(ctx, r.newInput(d, body))
+		},
+	}
+	handleSignals(func(os.Signal) {
+		log.Print("-serve: not taking any more jobs; exiting once those in progress are done")
+		s.stop()
+	})
+	log.Printf("Serving on %s", o.serveSocket)
+	if err := s.serve(ctx); err != nil {
+		return failf(exitError, "-serve: %v", err)
+	}
+	return nil
+}
+
+// addHooks runs -pre-command, and arranges for -post-command to be run on
+// exit. Both are run like cmd.
+func (r *runner) addHooks(ctx context.Context, cmd *exec.Cmd) error {
+	o := r.o
+	if o.preCommand != "" {
+		if err := runHook(ctx, cmd, o.preCommand); err != nil {
+			return failf(exitCommandFail, "-pre-command failed: %v", err)
+		}
+	}
+	if o.postCommand != "" {
+		notify := onExit
+		onExit = func(code int) int {
+			if code == exitOK || o.postAlways {
+				// Not ctx, which may have timed out already.
+				err := runHook(context.Background(), cmd, o.postCommand, fmt.Sprintf("CMD2S3_EXIT_CODE=%d", code))
+				if err != nil {
+					errorf("-post-command failed: %v", err)
+					if code == exitOK {
+						code = exitCommandFail
+					}
+				}
+			}
+			if notify != nil {
+				code = notify(code)
+			}
+			return code
+		}
+	}
+	return nil
+}
+
+// download is -download.
+func (r *runner) download(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.Stdout = os.Stdout
+	code, err := runDownload(ctx, r.svc, r.dests[0], cmd, r.o.gunzip, r.o.spoolTo)
+	if err != nil {
+		return failf(code, "%v: %s", r.dests[0], describeError(err))
+	}
+	return nil
+}
+
+// output is the command's output, or -stdin or -input-fd, on its way to
+// be uploaded.
+type output struct {
+	body io.Reader
+
+	// rawCounter counts the output before it's compressed, and counter
+	// after.
+	rawCounter, counter *countingReader
+
+	hash  hash.Hash // with -checksum-stdout or -write-sums
+	etags *etagHash // with -verify-etag
+
+	// empty is set if -skip-empty found the output is empty, and there's
+	// nothing to upload.
+	empty bool
+
+	// waitErr is set if the command, or an -also-command, failed.
+	waitErr error
+	// interrupted returns the signal which stopped the command, if any.
+	interrupted func() os.Signal
+}
+
+// startOutput starts cmd, unless the data comes from -stdin or -input-fd,
+// and returns its output, as the flags say to upload it.
+func (r *runner) startOutput(ctx context.Context, cmd *exec.Cmd) (*output, error) {
+	o := r.o
+	out := &output{}
+	var (
+		cmdStdout io.ReadCloser
+		err       error
+		// running is the command whose output is being read.
+		running atomic.Pointer[exec.Cmd]
+	)
+	// waitFor returns a function which waits for c to exit, for
+	// readWithWaitError, and sets out.waitErr if it failed. name says
+	// which command c is, unless it's the main one.
+	waitFor := func(c *exec.Cmd, name string) func() error {
+		_, endSpan := startSpan(ctx, "command")
+		return func() error {
+			err := c.Wait()
+			endSpan(spanAttrs{}, err)
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && o.successCodes.contains(exitErr.ExitCode()) {
+				debugf("The command exited with status %d, which -success-exit-codes allows", exitErr.ExitCode())
+				err = nil
+			} else if err == nil && !o.successCodes.contains(0) {
+				err = errors.New("exit status 0, which isn't one of -success-exit-codes")
+			}
+			if sig, ok := stoppedBy(c.ProcessState); ok && o.killTimeout > 0 {
+				log.Printf("The command was stopped by a signal: %v", sig)
+			}
+			if err == nil {
+				return nil
+			}
+			if name != "" {
+				err = fmt.Errorf("%s: %w", name, err)
+			}
+			out.waitErr = err
+			if o.uploadPartial {
+				// Finish the upload as if all went well; waitErr
+				// is dealt with afterwards.
+				return nil
+			}
+			return out.waitErr
+		}
+	}
+	if r.fromInput {
+		if r.inputFile != nil {
+			cmdStdout = r.inputFile
+		} else {
+			cmdStdout, err = openInput(ctx, o.stdinFile)
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil, failf(exitTimeout, "-stdin: %s waiting for a writer to open %s", r.timedOut(), o.stdinFile)
+			} else if err != nil {
+				return nil, failf(exitError, "-stdin: %v", err)
+			}
+		}
+		if o.readRetries > 0 {
+			cmdStdout = &retryingReader{ReadCloser: cmdStdout, attempts: o.readRetries}
+		}
+	} else {
+		var started func()
+		cmdStdout, started, err = outputPipe(cmd, o.combineOutput)
+		if err != nil {
+			return nil, failf(exitError, "%v", err)
+		}
+
+		// Note: This is what waits on the process and checks the exit
+		// status. It's necessary because Reads on cmdStdout can race
+		// with Wait, so the wait must come after.
+		if o.readRetries > 0 {
+			cmdStdout = &retryingReader{ReadCloser: cmdStdout, attempts: o.readRetries}
+		}
+		cmdStdout = readWithWaitError(cmdStdout, waitFor(cmd, ""))
+
+		err = cmd.Start()
+		started()
+		if err != nil {
+			return nil, failf(exitCommandStart, "Invoking shell command %q: %v", r.command, err)
+		}
+		running.Store(cmd)
+	}
+	out.interrupted = handleSignals(func(sig os.Signal) {
+		c := running.Load()
+		if c == nil {
+			// -stdin: closing the input ends it.
+			cmdStdout.Close()
+		} else if err := c.Process.Signal(sig); err != nil {
+			c.Process.Kill()
+		} else if o.killTimeout > 0 {
+			killAfter(c, o.killTimeout)
+		}
+	})
+
+	var stdout io.Reader = cmdStdout
+	if len(o.alsoCommands) > 0 {
+		readers := []io.Reader{cmdStdout}
+		for _, also := range o.alsoCommands {
+			name := fmt.Sprintf("-also-command %q", also)
+			readers = append(readers, &lazyReader{open: func() (io.Reader, error) {
+				if out.waitErr != nil || out.interrupted() != nil {
+					// Only possible with -upload-partial-on-failure.
+					return strings.NewReader(""), nil
+				}
+				c := likeCommand(ctx, cmd, also)
+				if o.killTimeout > 0 {
+					stopGently(c, o.killTimeout)
+				}
+				pipe, started, err := outputPipe(c, o.combineOutput)
+				if err == nil {
+					err = c.Start()
+					started()
+				}
+				if err != nil {
+					out.waitErr = fmt.Errorf("%s: %w", name, err)
+					if o.uploadPartial {
+						return strings.NewReader(""), nil
+					}
+					return nil, out.waitErr
+				}
+				running.Store(c)
+				debugf("Running %s", name)
+				if o.readRetries > 0 {
+					pipe = &retryingReader{ReadCloser: pipe, attempts: o.readRetries}
+				}
+				return readWithWaitError(pipe, waitFor(c, name)), nil
+			}})
+		}
+		stdout = io.MultiReader(readers...)
 	}
 
-	s3url, command := args[0], args[1]
+	if o.destFromFirstLine {
+		br := bufio.NewReaderSize(stdout, 4096)
+		line, err := br.ReadSlice('\n')
+		switch {
+		case out.waitErr != nil:
+			return nil, failf(exitCommandFail, "shell command failed before writing a destination: %v", out.waitErr)
+		case err == bufio.ErrBufferFull:
+			return nil, failf(exitError, "-dest-from-first-line: the first line of output is too long for an s3 URL")
+		case err != nil:
+			return nil, failf(exitError, "-dest-from-first-line: reading the first line of output: %v", err)
+		}
+		bucket, key, options, err := parseS3URL(strings.TrimSpace(string(line)))
+		if err != nil {
+			return nil, failf(exitError, "-dest-from-first-line: invalid URL: %v", err)
+		}
+		if redactor != nil {
+			redactor.add(*key)
+		}
+		if o.strictKeys {
+			if err := checkKey(*key); err != nil {
+				return nil, failf(exitError, "-dest-from-first-line: -strict-keys: %v", err)
+			}
+		}
+		d, err := r.newDestination(bucket, key, options)
+		if err != nil {
+			return nil, failf(exitError, "-dest-from-first-line: %v", err)
+		}
+		r.dests = []destination{d}
+		log.Printf("Uploading to %v", d)
+		stdout = br
+	}
+	if o.coalesce > 0 {
+		stdout = &coalescingReader{r: stdout, size: int(o.coalesce)}
+	}
+	if r.inferType {
+		var (
+			sniffed string
+			peeked  bool
+		)
+		sniff := func() string {
+			if !peeked {
+				// Peek at what the command writes first; 512 bytes
+				// is all DetectContentType looks at.
+				br := bufio.NewReaderSize(stdout, 512)
+				if head, _ := br.Peek(512); len(head) > 0 {
+					sniffed = http.DetectContentType(head)
+				}
+				stdout, peeked = br, true
+			}
+			return sniffed
+		}
+		for i := range r.dests {
+			r.dests[i].contentType = contentTypeFor(r.dests[i], r.byExt, o.compress == "gzip", sniff)
+		}
+	}
+	if o.maxLines > 0 {
+		stdout = &lineLimiter{Reader: stdout, max: o.maxLines}
+	}
+	if o.skipEmpty {
+		br := bufio.NewReader(stdout)
+		if _, err := br.Peek(1); err == io.EOF {
+			out.empty = true
+			return out, nil
+		}
+		stdout = br
+	}
+	out.rawCounter = &countingReader{Reader: stdout}
+	stdout = out.rawCounter
+	if r.encoding == "auto" {
+		br := bufio.NewReader(stdout)
+		head, _ := br.Peek(magicLen)
+		stdout = br
+		r.encoding = "gzip"
+		if isCompressed(head) {
+			debugf("-compress auto: the output is compressed already, so uploading it as it is")
+			r.encoding = ""
+		}
+	}
+	if r.encoding != "" {
+		if o.readBufferSize > 0 && o.compressLevel != "auto" {
+			// gzip reads what it compresses 32KiB at a time, which
+			// is a lot of small reads of a fast command. The
+			// uploader reads whole parts, which a buffer only
+			// copies, and -compress-level auto reads 1MiB.
+			stdout = bufio.NewReaderSize(stdout, int(o.readBufferSize))
+		}
+		stdout = gzipStream(ctx, stdout, r.level, o.compressLevel == "auto")
+	}
+	out.counter = &countingReader{Reader: stdout}
 
-	bucket, key, err := parseS3URL(s3url)
-	if err != nil {
-		log.Fatalf("invalid URL: %v", err)
+	out.body = &partLimitWarner{Reader: out.counter, partSize: int64(o.partSize), maxParts: int64(o.maxParts)}
+	if o.teeFilename != "" {
+		tee, err := newTeeFile(out.body, o.teeFilename, o.teeFsync || o.teeFsyncInterval > 0, o.teeFsyncInterval)
+		if err != nil {
+			return nil, failf(exitError, "-tee: %v", err)
+		}
+		out.body = tee
+	}
+	out.hash = sha256.New()
+	if o.checksumStdout || o.writeSums != "" {
+		out.body = io.TeeReader(out.body, out.hash)
 	}
+	out.etags = newETagHash(int64(o.partSize))
+	if o.verifyETag {
+		out.body = io.TeeReader(out.body, out.etags)
+	}
+	return out, nil
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// uploadMoreParts is -upload-id.
+func (r *runner) uploadMoreParts(ctx context.Context, out *output) error {
+	d := r.dests[0]
+	upload := &multipartUpload{bucket: d.bucket, key: d.key, uploadID: aws.String(r.o.resumeUploadID)}
+	parts, err := listParts(ctx, r.svc, upload)
+	if err == nil && len(parts) > 0 {
+		if last := parts[len(parts)-1]; aws.ToInt64(last.Size) < manager.MinUploadPartSize {
+			err = fmt.Errorf("part %d is only %d bytes, so it must be the last part", aws.ToInt32(last.PartNumber), aws.ToInt64(last.Size))
+		}
+	}
+	if err != nil {
+		return failf(exitUploadFail, "%v: %s", d, describeError(err))
+	}
+	next := int32(len(parts) + 1)
+	completed, err := uploadParts(ctx, r.svc, upload, next, int64(r.o.partSize), int32(r.o.maxParts), !r.o.disableContentMD5, out.body)
+	if err != nil {
+		code := exitUploadFail
+		if out.waitErr != nil {
+			code = exitCommandFail
+		}
+		return failf(code, "%v: uploaded %d parts from part %d: %s", d, len(completed), next, describeError(err))
+	}
+	if len(completed) == 0 {
+		warnf("%v: the command wrote nothing, so no parts were uploaded", d)
+		return nil
+	}
+	successf("Uploaded parts %d to %d of %v - %v", next, int(next)+len(completed)-1, d, r.o.resumeUploadID)
+	return nil
+}
 
-	cmd := exec.CommandContext(ctx, "sh", "-c", command)
-	cmd.Stderr = os.Stderr
-	cmdStdout, err := cmd.StdoutPipe()
+// resume is -resume-upload-id, carrying on from rp.
+func (r *runner) resume(ctx context.Context, out *output, rp *resumePoint) error {
+	d := r.dests[0]
+	next := int32(len(rp.parts) + 1)
+	completed, err := uploadParts(ctx, r.svc, rp.upload, next, int64(r.o.partSize), int32(r.o.maxParts), !r.o.disableContentMD5, out.body)
+	if err != nil {
+		code := exitUploadFail
+		if out.waitErr != nil {
+			code = exitCommandFail
+		}
+		// The upload is left as it is, to be resumed again.
+		return failf(code, "%v: uploaded %d parts from part %d: %s; resume with -resume-from-part %d",
+			d, len(completed), next, describeError(err), int(next)+len(completed))
+	}
+	all := append(rp.parts, completed...)
+	if len(all) == 0 {
+		return failf(exitUploadFail, "%v: no parts have been uploaded", d)
+	}
+	_, err = completeUpload(ctx, r.svc, rp.upload, all)
 	if err != nil {
-		log.Fatal(err)
+		return failf(exitUploadFail, "%v: %s", d, describeError(err))
+	}
+	successf("Object uploaded: %v - %v (%d parts)", d, r.o.resumeID, len(all))
+	return nil
+}
+
+// upload is a normal upload of out, to each destination.
+func (r *runner) upload(ctx context.Context, out *output) error {
+	o, svc, dests := r.o, r.svc, r.dests
+	body := out.body
+	// sums is what -write-sums uploads, for the destinations skipped as
+	// unchanged as well as those uploaded.
+	var sums strings.Builder
+	if o.skipUnchanged {
+		f, s, err := spool(body)
+		if out.waitErr != nil && err != nil {
+			return failf(exitCommandFail, "shell command failed: %v", out.waitErr)
+		} else if err != nil {
+			return failf(exitError, "-skip-if-unchanged: %v", err)
+		}
+		remove := func() {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		atExit(func(int) { remove() })
+		defer remove()
+		r.sum, body = s, f
+		changed := dests[:0:0]
+		for _, d := range dests {
+			same, err := unchanged(ctx, svc, d, r.sum)
+			if err != nil {
+				return failf(exitUploadFail, "%v: -skip-if-unchanged: %s", d, describeError(err))
+			}
+			if same {
+				successf("%v: unchanged, skipped", d)
+				fmt.Fprintf(&sums, "%x  %s\n", out.hash.Sum(nil), *d.key)
+				continue
+			}
+			changed = append(changed, d)
+		}
+		if len(changed) == 0 {
+			if o.writeSums != "" {
+				if err := r.writeSums(ctx, sums.String()); err != nil {
+					return failf(exitUploadFail, "%v: -write-sums: %s", r.sumsDest, describeError(err))
+				}
+			}
+			return nil
+		}
+		dests = changed
 	}
 
-	// Note: This is what waits on the process and checks the exit status.
-	// It's necessary because Reads on cmdStdout can race with Wait, so
-	// the wait must come after.
-	cmdStdout = readWithWaitError(cmdStdout, cmd.Wait)
+	streamed := dests[:min(len(dests), o.maxFiles)]
+	bodies := []io.Reader{body}
+	if len(streamed) > 1 {
+		bodies = bodies[:0]
+		for _, pr := range fanOut(body, len(streamed)) {
+			bodies = append(bodies, pr)
+		}
+	}
 
-	err = cmd.Start()
-	if err != nil {
-		log.Fatalf("Invoking shell command %q: %v", command, err)
+	stopHeartbeat := func() {}
+	switch {
+	case o.progressJSON:
+		interval := o.heartbeat
+		if interval <= 0 {
+			interval = time.Second
+		}
+		stopHeartbeat = startProgressJSON(r.progressOut, interval, out.counter)
+	case o.heartbeat > 0:
+		logger := log.Default()
+		if r.progressOut != os.Stderr {
+			logger = log.New(r.progressOut, "", log.LstdFlags)
+		}
+		stopHeartbeat = startHeartbeat(logger, o.heartbeat, out.counter)
+	}
+
+	partSize := int64(o.partSize)
+	resps := make([]*manager.UploadOutput, len(dests))
+	errs := make([]error, len(dests))
+	var wg sync.WaitGroup
+	for i, d := range streamed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, endSpan := startSpan(ctx, "upload")
+			if o.forceMultipart {
+				var (
+					id   string
+					etag *string
+				)
+				id, etag, errs[i] = uploadStream(ctx, svc, r.newCreateInput(d), partSize, int32(o.maxParts), !o.disableContentMD5, bodies[i])
+				resps[i] = &manager.UploadOutput{Location: d.String(), UploadID: id, ETag: etag}
+				if errors.Is(errs[i], errEmptyStream) {
+					resps[i], errs[i] = r.uploader.Upload(ctx, r.newInput(d, strings.NewReader("")))
+				}
+			} else {
+				resps[i], errs[i] = r.uploader.Upload(ctx, r.newInput(d, bodies[i]))
+			}
+			n := out.counter.n.Load()
+			endSpan(spanAttrs{bucket: *d.bucket, key: *d.key, bytes: n, parts: max(1, (n+partSize-1)/partSize)}, errs[i])
+			if pr, ok := bodies[i].(*io.PipeReader); ok && errs[i] != nil {
+				// Stop feeding the other destinations too.
+				pr.CloseWithError(errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	stopHeartbeat()
+
+	code := exitOK
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			errorf("%v: %s: %v", dests[i], r.timedOut(), err)
+			code = exitTimeout
+		case out.interrupted() != nil:
+			errorf("%v: interrupted by %v: %v", dests[i], out.interrupted(), err)
+			code = exitInterrupted
+		case out.waitErr != nil:
+			errorf("%v: shell command failed after writing %d bytes: %v", dests[i], out.rawCounter.n.Load(), out.waitErr)
+			code = exitCommandFail
+		case errors.Is(err, errTooManyLines):
+			errorf("%v: %v", dests[i], err)
+			code = exitCommandFail
+		default:
+			errorf("%v: %s", dests[i], describeError(err))
+			code = exitUploadFail
+		}
+	}
+	if code != exitOK {
+		return exitStatus(code)
+	}
+	if out.rawCounter.n.Load() == 0 {
+		what := "the command succeeded but wrote nothing"
+		if o.stdinFile != "" {
+			what = "-stdin was empty"
+		} else if r.inputFile != nil {
+			what = fmt.Sprintf("-input-fd %d was empty", o.inputFD)
+		}
+		warnf("%s, so the object holds no data; -skip-empty skips the upload instead", what)
+	}
+
+	if len(dests) > len(streamed) {
+		copied := dests[len(streamed):]
+		log.Printf("Copying %v to %d more destinations", dests[0], len(copied))
+		sem := make(chan struct{}, o.maxFiles)
+		var done atomic.Int32
+		for i := len(streamed); i < len(dests); i++ {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				d := dests[i]
+				resps[i], errs[i] = runCopy(ctx, svc, o.concurrency, !o.disableContentMD5, dests[0], r.newInput(d, nil), types.MetadataDirectiveReplace)
+				if errs[i] == nil {
+					log.Printf("Copied to %v (%d of %d)", d, done.Add(1), len(copied))
+				}
+			}()
+		}
+		wg.Wait()
+		for i, err := range errs[len(streamed):] {
+			if err != nil {
+				errorf("%v: copying from %v: %s", copied[i], dests[0], describeError(err))
+				code = exitUploadFail
+			}
+		}
+		if code != exitOK {
+			return exitStatus(code)
+		}
+	}
+
+	for i, d := range dests {
+		// resp is what's checked: the object as uploaded, or as
+		// -uncompressed-length-metadata copied it onto itself.
+		resp := resps[i]
+		if o.uncompressedLengthMeta {
+			input := r.newInput(d, nil)
+			if input.Metadata == nil {
+				input.Metadata = map[string]string{}
+			}
+			input.Metadata["uncompressed-length"] = strconv.FormatInt(out.rawCounter.n.Load(), 10)
+			copied, err := runCopy(ctx, svc, o.concurrency, !o.disableContentMD5, d, input, types.MetadataDirectiveReplace)
+			if err != nil {
+				errorf("%v: -uncompressed-length-metadata: %s", d, describeError(err))
+				code = exitUploadFail
+				continue
+			}
+			resp = copied
+		}
+
+		// The copies to the other destinations, and objects
+		// -uncompressed-length-metadata copied in parts, have ETags
+		// of their own, which only -verify checks.
+		if o.verifyETag && i < len(streamed) && (resp == resps[i] || resp.UploadID == "") {
+			if err := checkETag(d, resp, out.etags); err != nil {
+				errorf("%v: -verify-etag: %v", d, err)
+				code = exitVerifyFail
+				continue
+			}
+		}
+		if o.verify {
+			err := verifyUpload(ctx, svc, d.bucket, d.key, out.counter.n.Load(), resp.ETag)
+			if err != nil {
+				errorf("%v: verify failed: %v", d, err)
+				code = exitVerifyFail
+				continue
+			}
+		}
+
+		if o.waitAvail > 0 {
+			waited, err := waitAvailable(ctx, svc, d, o.waitAvail)
+			if err != nil {
+				errorf("%v: -wait-available: %s", d, describeError(err))
+				code = exitVerifyFail
+				continue
+			}
+			log.Printf("%v is available, after waiting %v", d, waited.Round(time.Millisecond))
+		}
+
+		if out.waitErr != nil {
+			// Only possible with -upload-partial-on-failure.
+			err := tagObject(ctx, svc, d, "cmd2s3-command-failed", out.waitErr.Error())
+			if err != nil {
+				errorf("%v: tagging partial upload: %v", d, err)
+			}
+			warnf("%v: shell command failed: %v; uploaded its partial output", d, out.waitErr)
+			code = exitCommandFail
+		}
+
+		if o.legalHoldAfter {
+			err := applyLegalHold(ctx, svc, d)
+			if err != nil {
+				errorf("%v: -apply-legal-hold-after: %s", d, describeError(err))
+				code = exitUploadFail
+				continue
+			}
+		}
+
+		successf("Object uploaded: %v - %v", resps[i].Location, resps[i].UploadID)
+
+		if o.checksumStdout {
+			fmt.Printf("%x  %s\n", out.hash.Sum(nil), *d.key)
+		}
+		fmt.Fprintf(&sums, "%x  %s\n", out.hash.Sum(nil), *d.key)
+
+		if o.printURLFormat != "" {
+			u, err := objectURL(o.printURLFormat, d, r.cfg.Region, s3Endpoint(r.cfg), o.dualStack)
+			if err != nil {
+				errorf("%v: -print-url-format: %v", d, err)
+				code = exitError
+				continue
+			}
+			fmt.Println(u)
+		}
+
+		if o.presignExpiry > 0 {
+			u, err := presignGet(ctx, svc, d, o.presignExpiry)
+			if err != nil {
+				errorf("%v: presign failed: %v", d, err)
+				code = exitError
+				continue
+			}
+			fmt.Println(u)
+		}
+	}
+	if o.writeSums != "" && code == exitOK {
+		if err := r.writeSums(ctx, sums.String()); err != nil {
+			errorf("%v: -write-sums: %s", r.sumsDest, describeError(err))
+			code = exitUploadFail
+		}
+	}
+	if out.interrupted() != nil && code != exitOK {
+		// Only possible with -upload-partial-on-failure.
+		code = exitInterrupted
+	}
+	if code != exitOK {
+		return exitStatus(code)
+	}
+	return nil
+}
+
+// writeSums uploads sums, a line for each object, to -write-sums.
+func (r *runner) writeSums(ctx context.Context, sums string) error {
+	input := r.newInput(r.sumsDest, strings.NewReader(sums))
+	// The sums themselves aren't compressed or the output.
+	input.ContentEncoding, input.Metadata = nil, nil
+	if _, err := r.uploader.Upload(ctx, input); err != nil {
+		return err
+	}
+	log.Printf("Wrote the SHA-256 of %d objects to %v", strings.Count(sums, "\n"), r.sumsDest)
+	return nil
+}
+
+// deadlineGrace is how long after -deadline cmd2s3 exits, if it hasn't
+// finished stopping by then. The tests shorten it.
+var deadlineGrace = 5 * time.Second
+
+// destination is an object that the command's output is uploaded to.
+type destination struct {
+	bucket, key *string
+	contentType string
+
+	// These are the flags of the same name, or the URL's options.
+	contentLanguage, sse, sseKMSKeyID, websiteRedirect string
+}
+
+func (d destination) String() string {
+	return "s3://" + *d.bucket + "/" + *d.key
+}
+
+// checkOptions checks the options d was given in its URL, as they're
+// checked for the flags.
+func (d destination) checkOptions(bucketKeyEnabled bool) error {
+	if d.websiteRedirect != "" {
+		if err := checkRedirectLocation(d.websiteRedirect); err != nil {
+			return fmt.Errorf("website-redirect-location: %v", err)
+		}
+	}
+	switch types.ServerSideEncryption(d.sse) {
+	case types.ServerSideEncryptionAes256:
+		if d.sseKMSKeyID != "" || bucketKeyEnabled {
+			return errors.New("sse-kms-key-id and -bucket-key-enabled require sse aws:kms")
+		}
+	case types.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("unsupported sse %q, want AES256 or aws:kms", d.sse)
+	}
+	return nil
+}
+
+// kmsAlias matches a KMS alias, or its ARN.
+var kmsAlias = regexp.MustCompile(`^(arn:[a-z-]+:kms:[a-z0-9-]+:[0-9]{12}:)?alias/[a-zA-Z0-9/_-]{1,250}$`)
+
+// checkKMSAlias checks that alias looks like alias/my-key or
+// arn:aws:kms:eu-west-2:111122223333:alias/my-key.
+func checkKMSAlias(alias string) error {
+	if !kmsAlias.MatchString(alias) {
+		return fmt.Errorf("%q isn't a KMS alias, e.g. alias/my-key, or an alias ARN", alias)
 	}
+	return nil
+}
 
-	cfg, err := config.LoadDefaultConfig(context.Background())
+// checkRedirectLocation checks that loc is something S3 accepts as a
+// WebsiteRedirectLocation: a path starting with "/" or an http(s) URL.
+func checkRedirectLocation(loc string) error {
+	u, err := url.Parse(loc)
 	if err != nil {
-		log.Fatalf("s4cat: unable to load config: %v", err)
+		return err
+	}
+	switch {
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//"):
+	case (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+	default:
+		return fmt.Errorf("%q is neither a path starting with / nor an http(s) URL", loc)
+	}
+	return nil
+}
+
+// commandEnv looks up the environment variable name as the command will see
+// it, given -exec-env and -exec-clear-env.
+func commandEnv(name string, execEnv []string, clearEnv bool) (string, bool) {
+	for i := len(execEnv) - 1; i >= 0; i-- {
+		if k, v, _ := strings.Cut(execEnv[i], "="); k == name {
+			return v, true
+		}
+	}
+	if clearEnv {
+		return "", false
+	}
+	return os.LookupEnv(name)
+}
+
+// checkKey checks that key is one which is unlikely to have been made by
+// mistake, for -strict-keys.
+func checkKey(key string) error {
+	switch {
+	case key == "":
+		return errors.New("the key is empty")
+	case len(key) > 1024:
+		return fmt.Errorf("the key is %d bytes long; S3 allows at most 1024", len(key))
+	case !utf8.ValidString(key):
+		return errors.New("the key isn't valid UTF-8")
+	case strings.HasPrefix(key, "/"):
+		return fmt.Errorf("the key %q starts with /", key)
+	}
+	if i := strings.IndexFunc(key, unicode.IsControl); i >= 0 {
+		return fmt.Errorf("the key %q contains the control character %U", key, []rune(key[i:])[0])
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "." || seg == ".." {
+			return fmt.Errorf("the key %q contains a %q segment", key, seg)
+		}
+	}
+	return nil
+}
+
+// tagObject adds the tag key=value to the object at d, with value made a
+// valid tag value by tagValue.
+func tagObject(ctx context.Context, svc *s3.Client, d destination, key, value string) error {
+	_, err := svc.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket: d.bucket,
+		Key:    d.key,
+		Tagging: &types.Tagging{
+			TagSet: []types.Tag{{Key: aws.String(key), Value: aws.String(tagValue(value))}},
+		},
+	})
+	return err
+}
+
+// maxTagValue is the most characters S3 allows in a tag value.
+const maxTagValue = 256
+
+// tagValue returns s with the characters S3 doesn't allow in a tag value,
+// such as quotes, replaced with underscores, and cut to maxTagValue
+// characters.
+func tagValue(s string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n == maxTagValue {
+			break
+		}
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != ' ' && !strings.ContainsRune("+-=._:/@", r) {
+			r = '_'
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// applyLegalHold turns on the Object Lock legal hold of d.
+func applyLegalHold(ctx context.Context, svc *s3.Client, d destination) error {
+	_, err := svc.PutObjectLegalHold(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket:    d.bucket,
+		Key:       d.key,
+		LegalHold: &types.ObjectLockLegalHold{Status: types.ObjectLockLegalHoldStatusOn},
+	})
+	if errorCode(err) == "InvalidRequest" {
+		// S3's complaint when the bucket doesn't have Object Lock enabled.
+		return fmt.Errorf("%w; is Object Lock enabled on the bucket?", err)
 	}
-	svc := s3.NewFromConfig(cfg)
+	return err
+}
 
-	uploader := manager.NewUploader(svc, func(u *manager.Uploader) {
-		// 128MiB per part (s3manager buffers these)
-		u.PartSize = 128 * 1024 * 1024
-		// Max 4 streams to s3 (=> max memory usage 512MiB).
-		u.Concurrency = 4
+// waitAvailable polls HeadObject until d can be seen, for at most timeout,
+// and returns how long that took.
+func waitAvailable(ctx context.Context, svc *s3.Client, d destination, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	w := s3.NewObjectExistsWaiter(svc, func(o *s3.ObjectExistsWaiterOptions) {
+		o.MinDelay = 250 * time.Millisecond
+		o.MaxDelay = 10 * time.Second
 	})
+	err := w.Wait(ctx, &s3.HeadObjectInput{Bucket: d.bucket, Key: d.key}, timeout)
+	return time.Since(start), err
+}
+
+// checkETag checks the ETag S3 returned for the upload to d against the one
+// worked out by h.
+func checkETag(d destination, resp *manager.UploadOutput, h *etagHash) error {
+	if strings.HasPrefix(d.sse, string(types.ServerSideEncryptionAwsKms)) {
+		debugf("%v: -verify-etag: skipped, as with SSE-KMS the ETag isn't an MD5", d)
+		return nil
+	}
+	if resp.ETag == nil {
+		return errors.New("S3 didn't return an ETag")
+	}
+	want := h.etag(resp.UploadID != "")
+	if got := *resp.ETag; !strings.EqualFold(strings.Trim(got, `"`), strings.Trim(want, `"`)) {
+		return fmt.Errorf("ETag mismatch: the data has %s, S3 returned %s", want, got)
+	}
+	return nil
+}
 
-	resp, err := uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket:               bucket,
-		Key:                  key,
-		ServerSideEncryption: types.ServerSideEncryptionAes256,
-		Body:                 cmdStdout,
+// verifyUpload checks that the object at bucket/key has the expected size and
+// ETag.
+func verifyUpload(ctx context.Context, svc *s3.Client, bucket, key *string, size int64, etag *string) error {
+	head, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: bucket,
+		Key:    key,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if got := aws.ToInt64(head.ContentLength); got != size {
+		return fmt.Errorf("size mismatch: read %d bytes from command, object is %d bytes", size, got)
+	}
+	if etag != nil && aws.ToString(head.ETag) != *etag {
+		return fmt.Errorf("ETag mismatch: uploaded %s, object has %s", *etag, aws.ToString(head.ETag))
 	}
+	return nil
+}
+
+// countingReader counts the bytes read through it. n may be read while
+// reads are in progress.
+type countingReader struct {
+	io.Reader
+	n atomic.Int64
+}
 
-	log.Printf("Object uploaded: %v - %v", resp.Location, resp.UploadID)
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// coalescingReader collects reads of r until it has size bytes, or r runs
+// out, so that a trickle of small writes by the command reaches the uploader
+// as fewer, larger reads.
+type coalescingReader struct {
+	r    io.Reader
+	size int
+}
+
+func (c *coalescingReader) Read(p []byte) (int, error) {
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+	n, err := io.ReadFull(c.r, p)
+	if err == io.ErrUnexpectedEOF {
+		// Only complain about the truncated read, not the end of the
+		// output; other errors, such as the command failing, pass
+		// through unchanged.
+		err = io.EOF
+	}
+	return n, err
 }
 
-func parseS3URL(urlStr string) (bucket, key *string, err error) {
+// parseS3URL returns the bucket, key and options of an s3://bucket/key URL.
+// The bucket may be an access point or Outposts access point ARN, as in
+// s3://arn:aws:s3:eu-west-2:111122223333:accesspoint/my-ap/key.
+func parseS3URL(urlStr string) (bucket, key *string, options map[string]string, err error) {
+	accessPoint, rest, err := cutAccessPointARN(urlStr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if accessPoint != "" {
+		// The ARN's colons aren't valid in a URL's host.
+		urlStr = "s3://access-point" + rest
+	}
 	u, err := url.Parse(urlStr)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	if u.Scheme != "s3" {
 		err = fmt.Errorf("only s3 urls supported, got: %q", urlStr)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	bucket = aws.String(u.Host)
+	if accessPoint != "" {
+		bucket = aws.String(accessPoint)
+	}
 	path := ""
 	if len(u.Path) > 0 {
 		path = u.Path[1:]
 	}
 	key = aws.String(path)
-	return bucket, key, nil
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%q: %v", urlStr, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		if !slices.Contains(urlOptions, name) {
+			return nil, nil, nil, fmt.Errorf("unknown option %q in %q, want one of %s", name, urlStr, strings.Join(urlOptions, ", "))
+		}
+		if len(query[name]) > 1 {
+			return nil, nil, nil, fmt.Errorf("option %q is given more than once in %q", name, urlStr)
+		}
+		if options == nil {
+			options = map[string]string{}
+		}
+		options[name] = query[name][0]
+	}
+	return bucket, key, options, nil
+}
+
+// cutAccessPointARN splits an s3:// URL whose bucket is an access point ARN
+// into the ARN and the rest of the URL, starting with the / before the key.
+// It returns an empty ARN if the bucket isn't an ARN.
+func cutAccessPointARN(urlStr string) (accessPoint, rest string, err error) {
+	s, ok := strings.CutPrefix(urlStr, "s3://arn:")
+	if !ok {
+		return "", urlStr, nil
+	}
+	s, query, hasQuery := strings.Cut("arn:"+s, "?")
+	fields := strings.SplitN(s, ":", 6)
+	if len(fields) < 6 {
+		return "", "", fmt.Errorf("%q: not an access point ARN", urlStr)
+	}
+	// The resource is accesspoint/name, or outpost/id/accesspoint/name
+	// for Outposts, and the key follows it.
+	segments := strings.SplitN(fields[5], "/", 5)
+	n := 0
+	switch {
+	case fields[2] == "s3" && len(segments) >= 2 && segments[0] == "accesspoint":
+		n = 2
+	case fields[2] == "s3-outposts" && len(segments) >= 4 && segments[0] == "outpost" && segments[2] == "accesspoint":
+		n = 4
+	}
+	if n == 0 || slices.Contains(segments[:n], "") {
+		return "", "", fmt.Errorf("%q: not an access point ARN, want arn:aws:s3:region:account:accesspoint/name "+
+			"or arn:aws:s3-outposts:region:account:outpost/id/accesspoint/name", urlStr)
+	}
+	accessPoint = strings.Join(fields[:5], ":") + ":" + strings.Join(segments[:n], "/")
+	a, err := arn.Parse(accessPoint)
+	if err != nil || a.Region == "" || len(a.AccountID) != 12 {
+		return "", "", fmt.Errorf("%q: invalid access point ARN, it needs a region and a 12 digit account ID", urlStr)
+	}
+	if len(segments) > n {
+		rest = "/" + strings.Join(segments[n:], "/")
+	}
+	if hasQuery {
+		rest += "?" + query
+	}
+	return accessPoint, rest, nil
 }
 
+// urlOptions are the flags which can also be given for each destination,
+// as query parameters of its URL, e.g. s3://bucket/key?sse=aws:kms. Flags
+// which are set take precedence.
+var urlOptions = []string{"content-language", "content-type", "sse", "sse-kms-key-id", "website-redirect-location"}
+
 // readWithWaitError makes reads from r call wait when EOF is reached. If wait
 // returns an error, that error is returned instead of EOF. This allows a
 // process to simply copy from r, learning about non-zero exit status
 // automatically along the way.
 func readWithWaitError(r io.ReadCloser, wait func() error) io.ReadCloser {
-	return &readWithWaitErrorImpl{r, wait}
+	return &readWithWaitErrorImpl{ReadCloser: r, wait: wait}
 }
 
 type readWithWaitErrorImpl struct {
 	io.ReadCloser
 	wait func() error
+
+	// done is set at the first EOF, after which Read always returns err.
+	// Wait closes the pipe, so the command can't write any more; a read
+	// of the pipe would fail rather than return EOF again, and calling
+	// Wait twice is an error too.
+	done bool
+	err  error
 }
 
 func (r *readWithWaitErrorImpl) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, r.err
+	}
 	n, err := r.ReadCloser.Read(p)
 	if err == io.EOF {
 		// We hit EOF, wait on process and pass process exit status out
-		// as error if there is one.
+		// as error if there is one. Any data read along with the EOF
+		// is still returned in p[:n].
 		err = r.wait()
 		if err == nil { // Note: Unusual condition "==", not "!=".
 			err = io.EOF
 		}
+		r.done, r.err = true, err
 	}
 	return n, err
 }
-
-func uploadStream(bucket, key string, r io.Reader) error {
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Fatalf("s4cat: unable to load config: %v", err)
-	}
-	svc := s3.NewFromConfig(cfg)
-
-	upload, err := svc.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{
-		Bucket:               aws.String(bucket), //TODO
-		Key:                  aws.String(key),    //TODO
-		ServerSideEncryption: types.ServerSideEncryptionAes256,
-	})
-	if err != nil {
-		return err
-	}
-
-	const (
-		MiB       = 1 << 20
-		chunkSize = 100 * MiB
-	)
-	parts, errors := chunkData(r, chunkSize)
-
-	var haveErr bool
-partsLoop:
-	for {
-		select {
-		case part, ok := <-parts:
-			if !ok {
-				break partsLoop
-			}
-
-			_, err = svc.UploadPart(context.Background(), &s3.UploadPartInput{
-				Bucket:   upload.Bucket,
-				Key:      upload.Key,
-				UploadId: upload.UploadId,
-				Body:     part,
-			})
-
-			if err != nil {
-				goto abort
-			}
-
-		case err, haveErr = <-errors:
-			if haveErr {
-				goto abort
-			}
-		}
-	}
-
-	// Wait for error or channel to be closed.
-	err, haveErr = <-errors
-	if haveErr {
-		goto abort
-	}
-
-	_, err = svc.CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
-		Bucket:   upload.Bucket,
-		Key:      upload.Key,
-		UploadId: upload.UploadId,
-	})
-	if err != nil {
-		goto abort
-	}
-
-	return nil
-
-abort:
-	_, err2 := svc.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
-		UploadId: upload.UploadId,
-	})
-	if err2 != nil {
-		log.Printf("s3c.AbortMultipartUpload: %v", err)
-	}
-	return err
-}
-
-// chunkData splits the content in r into chunks of size sz or smaller.
-func chunkData(r io.Reader, sz int64) (<-chan io.ReadSeeker, <-chan error) {
-	chunks := make(chan io.ReadSeeker, 2)
-	errors := make(chan error, 1)
-	go func() {
-		defer close(chunks)
-
-		for {
-			buf := &bytes.Buffer{}
-			n, err := io.Copy(buf, io.LimitReader(r, sz))
-			if err == io.EOF && n < sz {
-				return
-			}
-			if err != nil && err != io.EOF {
-				errors <- err
-				return
-			}
-			chunks <- bytes.NewReader(buf.Bytes())
-		}
-	}()
-	return chunks, errors
-}
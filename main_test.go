@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// fakeS3 is an in-process S3, which records the requests it's sent.
+type fakeS3 struct {
+	backend *s3mem.Backend
+
+	mu       sync.Mutex
+	requests []string       // "METHOD /bucket/key?query"
+	failures map[string]int // by prefix, as for sent
+
+	conns atomic.Int64 // connections made to it
+}
+
+// newFakeS3 starts a fakeS3 with the given buckets, and points the SDK at
+// it for the rest of the test.
+func newFakeS3(t testing.TB, buckets ...string) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{backend: s3mem.New(), failures: map[string]int{}}
+	for _, b := range buckets {
+		if err := f.backend.CreateBucket(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := gofakes3.New(f.backend).Server()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := r.Method + " " + r.URL.RequestURI()
+		f.mu.Lock()
+		f.requests = append(f.requests, req)
+		fail := false
+		for prefix, n := range f.failures {
+			if n > 0 && strings.HasPrefix(req, prefix) {
+				f.failures[prefix]--
+				fail = true
+			}
+		}
+		f.mu.Unlock()
+		if fail {
+			http.Error(w, "", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "test",
+		"AWS_SECRET_ACCESS_KEY":       "test",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_PROFILE":                 "",
+		"AWS_REGION":                  "us-east-1",
+		"AWS_ENDPOINT_URL":            "",
+		"AWS_ENDPOINT_URL_S3":         srv.URL,
+		"AWS_S3_USE_PATH_STYLE":       "true",
+		"AWS_EC2_METADATA_DISABLED":   "true",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+	} {
+		t.Setenv(k, v)
+	}
+	return f
+}
+
+// sent reports whether a request starting with prefix, e.g.
+// "DELETE /bucket/key?uploadId=", was sent.
+func (f *fakeS3) sent(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// failNext makes the next n requests starting with prefix fail with a 503.
+func (f *fakeS3) failNext(prefix string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[prefix] = n
+}
+
+// object returns the contents of bucket/key.
+func (f *fakeS3) object(t *testing.T, bucket, key string) []byte {
+	t.Helper()
+	obj, err := f.backend.GetObject(bucket, key, nil)
+	if err != nil {
+		t.Fatalf("getting %s/%s: %v", bucket, key, err)
+	}
+	defer obj.Contents.Close()
+	b, err := io.ReadAll(obj.Contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// metadata returns the metadata of bucket/key, including its Content-Type.
+func (f *fakeS3) metadata(t *testing.T, bucket, key string) map[string]string {
+	t.Helper()
+	obj, err := f.backend.HeadObject(bucket, key)
+	if err != nil {
+		t.Fatalf("getting %s/%s: %v", bucket, key, err)
+	}
+	return obj.Metadata
+}
+
+// put stores data as bucket/key.
+func (f *fakeS3) put(t *testing.T, bucket, key string, data []byte) {
+	t.Helper()
+	if _, err := f.backend.PutObject(bucket, key, nil, bytes.NewReader(data), int64(len(data)), nil); err != nil {
+		t.Fatalf("putting %s/%s: %v", bucket, key, err)
+	}
+}
+
+// runCmd2s3 calls run with args, as cmd2s3 would be given them, and
+// returns what it logged and its error. The global state it leaves behind
+// is reset once the test is done.
+func runCmd2s3(t testing.TB, args ...string) (string, error) {
+	t.Helper()
+	// No ~/.cmd2s3.yaml.
+	t.Setenv("HOME", t.TempDir())
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		onExit, cleanups = nil, nil
+		errorFile, logFile, redactor = nil, nil, nil
+		lastError, lastErr = "", nil
+		verbose, color = false, false
+	})
+	fs := flag.NewFlagSet("cmd2s3", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	err := run(args, fs)
+	t.Logf("cmd2s3 %q:\n%s", args, &logged)
+	return logged.String(), err
+}
+
+// exitCode is the exit code main would use for err.
+func exitCode(err error) int {
+	var f *failure
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &f):
+		return f.code
+	}
+	return exitError
+}
+
+func TestUploadCommandOutput(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	_, err := runCmd2s3(t, "s3://bucket/key", "printf 'hello, world'")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := s3.object(t, "bucket", "key"); string(got) != "hello, world" {
+		t.Errorf("uploaded %q, want %q", got, "hello, world")
+	}
+}
+
+func TestFailingCommandAbortsUpload(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	// More than a part, so that the upload is multipart by the time the
+	// command fails.
+	_, err := runCmd2s3(t, "-part-size", "5MiB", "s3://bucket/key", "head -c 6000000 /dev/zero; exit 1")
+	if code := exitCode(err); code != exitCommandFail {
+		t.Fatalf("exit code %d (%v), want %d", code, err, exitCommandFail)
+	}
+	if !s3.sent("POST /bucket/key?uploads") {
+		t.Fatal("no multipart upload was created")
+	}
+	if !s3.sent("DELETE /bucket/key?uploadId=") {
+		t.Error("the multipart upload wasn't aborted")
+	}
+	if _, err := s3.backend.HeadObject("bucket", "key"); err == nil {
+		t.Error("the object was created")
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"undefined flag", []string{"-no-such-flag", "s3://bucket/key", "true"}, exitUsage},
+		{"bad flag value", []string{"-sse", "rot13", "s3://bucket/key", "true"}, exitUsage},
+		{"missing shell", []string{"-shell", "/no/such/shell -c", "s3://bucket/key", "true"}, exitCommandStart},
+		{"command fails", []string{"s3://bucket/key", "echo partial; exit 3"}, exitCommandFail},
+		{"no such bucket", []string{"s3://no-such-bucket/key", "echo hello"}, exitUploadFail},
+		{"timeout", []string{"-timeout", "100ms", "s3://bucket/key", "exec sleep 10"}, exitTimeout},
+		{"corrupt gzip", []string{"-download", "-gunzip", "s3://bucket/plain", "cat"}, exitCorruptGzip},
+		{"other", []string{"-tee", "/no/such/dir/file", "s3://bucket/key", "echo hello"}, exitError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s3 := newFakeS3(t, "bucket")
+			s3.put(t, "bucket", "plain", []byte("not gzip\n"))
+			_, err := runCmd2s3(t, tc.args...)
+			var f *failure
+			if !errors.As(err, &f) {
+				t.Fatalf("run returned %v, want a *failure", err)
+			}
+			if f.code != tc.code {
+				t.Errorf("exit code %d (%v), want %d", f.code, err, tc.code)
+			}
+		})
+	}
+}
+
+func TestHeadBucketRetried(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	// As many as the SDK tries the request.
+	s3.failNext("HEAD /bucket", 3)
+	logged, err := runCmd2s3(t, "-retry-base-delay", "1ms", "s3://bucket/key", "echo hello")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if !strings.Contains(logged, "HeadBucket failed (attempt 1 of 4)") {
+		t.Error("the failed HeadBucket wasn't retried")
+	}
+	if got := s3.object(t, "bucket", "key"); string(got) != "hello\n" {
+		t.Errorf("uploaded %q, want %q", got, "hello\n")
+	}
+}
+
+func TestTagValue(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"exit status 1", "exit status 1"},
+		{"signal: killed", "signal: killed"},
+		{`exec: "sh": not found`, "exec: _sh_: not found"},
+		{"ünïcode/ok@host+1=2", "ünïcode/ok@host+1=2"},
+		{strings.Repeat("é", 300), strings.Repeat("é", maxTagValue)},
+	} {
+		if got := tagValue(tc.in); got != tc.want {
+			t.Errorf("tagValue(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestWriteSumsSkipIfUnchanged(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	const sum = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03" // of "hello\n"
+	if _, err := runCmd2s3(t, "-skip-if-unchanged", "s3://bucket/a", "echo hello"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, name := range []string{"one skipped", "all skipped"} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := runCmd2s3(t, "-skip-if-unchanged", "-write-sums", "s3://bucket/SHA256SUMS", "s3://bucket/a", "s3://bucket/b", "echo hello"); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			want := sum + "  a\n" + sum + "  b\n"
+			if got := s3.object(t, "bucket", "SHA256SUMS"); string(got) != want {
+				t.Errorf("-write-sums wrote %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		want string // logged
+	}{
+		{"no arguments", nil, "usage: cmd2s3"},
+		{"no command", []string{"s3://bucket/key"}, "usage: cmd2s3"},
+		{"empty command", []string{"s3://bucket/key", ""}, "the shell command is empty"},
+		{"blank command", []string{"s3://bucket/key", " \t\n"}, "the shell command is empty"},
+		{"not a destination", []string{"bucket/key", "echo hello"}, "bucket/key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s3 := newFakeS3(t, "bucket")
+			logged, err := runCmd2s3(t, tc.args...)
+			if code := exitCode(err); code != exitUsage {
+				t.Errorf("exit code %d (%v), want %d", code, err, exitUsage)
+			}
+			if msg := logged + fmt.Sprint(err); !strings.Contains(msg, tc.want) {
+				t.Errorf("%q doesn't say %q", msg, tc.want)
+			}
+			if _, err := s3.backend.HeadObject("bucket", "key"); err == nil {
+				t.Error("the object was created")
+			}
+		})
+	}
+}
+
+func TestReadWithWaitError(t *testing.T) {
+	for _, tc := range []struct {
+		name, command string
+		exitCode      int
+	}{
+		{"succeeds", "printf 'first '; sleep 0.2; printf second", 0},
+		{"fails", "printf 'first '; sleep 0.2; printf second; exit 3", 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := exec.Command("sh", "-c", tc.command)
+			out, err := c.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Start(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(readWithWaitError(out, c.Wait))
+			if string(got) != "first second" {
+				t.Errorf("read %q, want %q", got, "first second")
+			}
+			var exitErr *exec.ExitError
+			switch {
+			case tc.exitCode == 0 && err != nil:
+				t.Errorf("read error %v, want none", err)
+			case tc.exitCode != 0 && (!errors.As(err, &exitErr) || exitErr.ExitCode() != tc.exitCode):
+				t.Errorf("read error %v, want exit status %d", err, tc.exitCode)
+			}
+		})
+	}
+}
+
+func TestReadWithWaitErrorDataWithEOF(t *testing.T) {
+	waits := 0
+	r := readWithWaitError(io.NopCloser(iotest.DataErrReader(strings.NewReader("hello"))), func() error {
+		waits++
+		return nil
+	})
+	got, err := io.ReadAll(r)
+	if string(got) != "hello" || err != nil {
+		t.Errorf("read %q, %v; want %q", got, err, "hello")
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("reading again: %d, %v; want EOF", n, err)
+	}
+	if waits != 1 {
+		t.Errorf("wait called %d times, want once", waits)
+	}
+}
+
+func TestEmptyOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		skip bool
+	}{
+		{"uploaded", nil, false},
+		{"skipped", []string{"-skip-empty"}, true},
+		// It's uploaded in parts, so long as there's anything to
+		// upload.
+		{"partial on failure", []string{"-upload-partial-on-failure"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s3 := newFakeS3(t, "bucket")
+			logged, err := runCmd2s3(t, append(tc.args, "s3://bucket/key", "true")...)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if tc.skip {
+				if _, err := s3.backend.HeadObject("bucket", "key"); err == nil {
+					t.Error("-skip-empty uploaded the object")
+				}
+				return
+			}
+			if got := s3.object(t, "bucket", "key"); len(got) != 0 {
+				t.Errorf("uploaded %q, want an empty object", got)
+			}
+			if !strings.Contains(logged, "warning: the command succeeded but wrote nothing") {
+				t.Error("no warning that the object is empty")
+			}
+			if s3.sent("POST /bucket/key?uploads") {
+				t.Error("a multipart upload was created for no data")
+			}
+		})
+	}
+}
+
+func TestDeadlineAfterRun(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	defer func(grace time.Duration) { deadlineGrace = grace }(deadlineGrace)
+	deadlineGrace = 10 * time.Millisecond
+	var exited atomic.Bool
+	hardExit = func(int) { exited.Store(true) }
+	defer func() { hardExit = func(int) {} }()
+
+	deadline := time.Now().Add(100 * time.Millisecond).Format(time.RFC3339Nano)
+	if _, err := runCmd2s3(t, "-deadline", deadline, "s3://bucket/key", "echo hello"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := s3.object(t, "bucket", "key"); string(got) != "hello\n" {
+		t.Errorf("uploaded %q, want %q", got, "hello\n")
+	}
+	// Past the deadline and its grace, which don't matter once run has
+	// returned.
+	time.Sleep(300 * time.Millisecond)
+	if exited.Load() {
+		t.Error("-deadline exited after run had returned")
+	}
+}
+
+// BenchmarkReadBuffer reads a pipe written to as fast as can be, with and
+// without -read-buffer-size's buffer, as gzip does, in reads of io.Copy's
+// 32KiB, and as the uploader does, in reads of a part.
+func BenchmarkReadBuffer(b *testing.B) {
+	const total = 256 << 20
+	for _, readSize := range []int{32 << 10, 8 << 20} {
+		for _, bufSize := range []int{0, 64 << 10, 1 << 20} {
+			b.Run(fmt.Sprintf("read=%d/buffer=%d", readSize, bufSize), func(b *testing.B) {
+				b.SetBytes(total)
+				chunk := make([]byte, 1<<20)
+				p := make([]byte, readSize)
+				for b.Loop() {
+					pr, pw, err := os.Pipe()
+					if err != nil {
+						b.Fatal(err)
+					}
+					go func() {
+						for n := 0; n < total; n += len(chunk) {
+							pw.Write(chunk)
+						}
+						pw.Close()
+					}()
+					var r io.Reader = pr
+					if bufSize > 0 {
+						r = bufio.NewReaderSize(r, bufSize)
+					}
+					for {
+						if _, err := io.ReadFull(r, p); err != nil {
+							break
+						}
+					}
+					pr.Close()
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkConcurrentUpload uploads 320MiB 16 parts at a time, keeping
+// fewer idle connections for reuse than that, as many as the SDK keeps by
+// default, and as many as there are parts uploading, and reports the
+// connections made for each upload.
+func BenchmarkConcurrentUpload(b *testing.B) {
+	const size = 320 << 20
+	for _, idle := range []int{2, awshttp.DefaultHTTPTransportMaxIdleConnsPerHost, 16} {
+		b.Run(fmt.Sprintf("max-idle-conns-per-host=%d", idle), func(b *testing.B) {
+			s3 := newFakeS3(b, "bucket")
+			b.SetBytes(size)
+			for b.Loop() {
+				_, err := runCmd2s3(b, "-part-size", "5MiB", "-concurrency", "16", "-max-idle-conns-per-host", fmt.Sprint(idle),
+					"s3://bucket/key", fmt.Sprintf("head -c %d /dev/zero", size))
+				if err != nil {
+					b.Fatalf("run: %v", err)
+				}
+			}
+			b.ReportMetric(float64(s3.conns.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
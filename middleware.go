@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// logUploadID logs the UploadId of each multipart upload as soon as it is
+// created, so that a slow or stuck transfer can be found with
+// ListMultipartUploads while it is still in progress.
+func logUploadID(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("LogUploadID", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		out, md, err := next.HandleInitialize(ctx, in)
+		if res, ok := out.Result.(*s3.CreateMultipartUploadOutput); ok && err == nil {
+			log.Printf("Multipart upload initiated: %v", aws.ToString(res.UploadId))
+		}
+		return out, md, err
+	}), middleware.After)
+}
+
+// putObjectMD5 sets the Content-MD5 of a PutObject whose body can be read
+// twice, as the uploader's is when the output fits in a single part, so that S3
+// rejects a body which was corrupted on the way.
+func putObjectMD5(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("PutObjectMD5", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		input, ok := in.Parameters.(*s3.PutObjectInput)
+		if !ok || input.ContentMD5 != nil {
+			return next.HandleInitialize(ctx, in)
+		}
+		body, ok := input.Body.(io.ReadSeeker)
+		if !ok {
+			return next.HandleInitialize(ctx, in)
+		}
+		start, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return middleware.InitializeOutput{}, middleware.Metadata{}, err
+		}
+		h := md5.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return middleware.InitializeOutput{}, middleware.Metadata{}, fmt.Errorf("computing Content-MD5: %w", err)
+		}
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return middleware.InitializeOutput{}, middleware.Metadata{}, err
+		}
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		return next.HandleInitialize(ctx, in)
+	}), middleware.Before)
+}
+
+// logRetries logs each retry the SDK makes, with why the attempt before it
+// failed and how long the SDK waited, so that throttling shows up as more
+// than a mysteriously slow upload.
+func logRetries(stack *middleware.Stack) error {
+	if _, ok := stack.Finalize.Get("Retry"); !ok {
+		return nil
+	}
+	type attempts struct {
+		n    int
+		err  error
+		done time.Time
+	}
+	type attemptsKey struct{}
+	err := stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("LogRetriesStart", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		return next.HandleFinalize(middleware.WithStackValue(ctx, attemptsKey{}, &attempts{}), in)
+	}), "Retry", middleware.Before)
+	if err != nil {
+		return err
+	}
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("LogRetries", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		a, ok := middleware.GetStackValue(ctx, attemptsKey{}).(*attempts)
+		if !ok {
+			return next.HandleFinalize(ctx, in)
+		}
+		a.n++
+		if a.n > 1 {
+			reason := errorCode(a.err)
+			if reason == "" {
+				reason = a.err.Error()
+			}
+			log.Printf("Retrying %s, attempt %d, after %v: %s",
+				awsmiddleware.GetOperationName(ctx), a.n, time.Since(a.done).Round(time.Millisecond), reason)
+		}
+		out, md, err := next.HandleFinalize(ctx, in)
+		a.err, a.done = err, time.Now()
+		return out, md, err
+	}), "Retry", middleware.After)
+}
+
+// writeUploadID returns a middleware which writes the UploadId of each
+// multipart upload to filename as soon as it is created, before any parts
+// are uploaded, so that a supervisor can resume or abort the upload if
+// cmd2s3 dies. If the file can't be written, it aborts the upload with the
+// client svc returns, since nothing else would know of it.
+func writeUploadID(filename string, svc func() multipartAPI) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("WriteUploadID", func(
+			ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+		) (middleware.InitializeOutput, middleware.Metadata, error) {
+			out, md, err := next.HandleInitialize(ctx, in)
+			if res, ok := out.Result.(*s3.CreateMultipartUploadOutput); ok && err == nil {
+				id := aws.ToString(res.UploadId)
+				if err := writeFileAtomic(filename, []byte(id+"\n")); err != nil {
+					in := in.Parameters.(*s3.CreateMultipartUploadInput)
+					abortUpload(svc(), &multipartUpload{bucket: in.Bucket, key: in.Key, uploadID: res.UploadId})
+					return out, md, fmt.Errorf("writing UploadId %s: %w", id, err)
+				}
+			}
+			return out, md, err
+		}), middleware.After)
+	}
+}
+
+// writeFileAtomic writes data to filename, so that readers of filename see
+// either its old content or all of data.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
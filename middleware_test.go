@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogUploadID(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"uploader", []string{"-part-size", "5MiB", "s3://bucket/key", "head -c 6000000 /dev/zero"}},
+		{"-force-multipart", []string{"-force-multipart", "s3://bucket/key", "echo hello"}},
+		{"-initiate-only", []string{"-initiate-only", "s3://bucket/key"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newFakeS3(t, "bucket")
+			logged, err := runCmd2s3(t, append([]string{"-log-upload-id"}, tc.args...)...)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if n := strings.Count(logged, "Multipart upload initiated: "); n != 1 {
+				t.Errorf("the UploadId was logged %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestUploadIDFileUnwritable(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"uploader", []string{"-part-size", "5MiB", "s3://bucket/key", "head -c 6000000 /dev/zero"}},
+		{"-force-multipart", []string{"-force-multipart", "s3://bucket/key", "echo hello"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s3 := newFakeS3(t, "bucket")
+			// Even root can't write to a directory which isn't there.
+			filename := filepath.Join(t.TempDir(), "missing", "upload-id")
+			_, err := runCmd2s3(t, append([]string{"-upload-id-output-file", filename}, tc.args...)...)
+			if err == nil {
+				t.Fatal("run succeeded, want the UploadId file to fail")
+			}
+			if !s3.sent("POST /bucket/key?uploads") {
+				t.Fatal("no multipart upload was created")
+			}
+			if !s3.sent("DELETE /bucket/key?uploadId=") {
+				t.Error("the multipart upload wasn't aborted")
+			}
+		})
+	}
+}
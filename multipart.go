@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// multipartAPI is the subset of *s3.Client used for manual multipart uploads.
+type multipartAPI interface {
+	CreateMultipartUpload(context.Context, *s3.CreateMultipartUploadInput, ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(context.Context, *s3.UploadPartInput, ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(context.Context, *s3.CompleteMultipartUploadInput, ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListParts(context.Context, *s3.ListPartsInput, ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+}
+
+// multipartUpload identifies an in-progress multipart upload.
+type multipartUpload struct {
+	bucket, key, uploadID *string
+	// sha256 is whether the upload was created with the SHA256 checksum
+	// algorithm, so each part needs a ChecksumSHA256.
+	sha256 bool
+}
+
+// createInput returns the CreateMultipartUploadInput equivalent of p, with
+// SHA256 checksums for the parts if checksums is set, as it is without
+// -disable-content-md5.
+func createInput(p *s3.PutObjectInput, checksums bool) *s3.CreateMultipartUploadInput {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:                  p.Bucket,
+		Key:                     p.Key,
+		ContentType:             p.ContentType,
+		ContentEncoding:         p.ContentEncoding,
+		ContentLanguage:         p.ContentLanguage,
+		Metadata:                p.Metadata,
+		ServerSideEncryption:    p.ServerSideEncryption,
+		SSEKMSKeyId:             p.SSEKMSKeyId,
+		BucketKeyEnabled:        p.BucketKeyEnabled,
+		WebsiteRedirectLocation: p.WebsiteRedirectLocation,
+	}
+	if checksums {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+	return input
+}
+
+// errEmptyStream is returned by uploadStream when there's nothing to upload.
+var errEmptyStream = errors.New("the stream is empty")
+
+// uploadStream uploads the content of r as a multipart upload, one part at a
+// time, and returns its UploadId and ETag. The upload is aborted if anything goes
+// wrong. If r is empty, no upload is started and it returns errEmptyStream,
+// so that the caller can upload an empty object with PutObject instead.
+// maxParts and contentMD5 are as for uploadParts.
+func uploadStream(ctx context.Context, svc multipartAPI, input *s3.CreateMultipartUploadInput, partSize int64, maxParts int32, contentMD5 bool, r io.Reader) (string, *string, error) {
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return "", nil, errEmptyStream
+	}
+
+	upload, err := initiateUpload(ctx, svc, input)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// chunkData never sends an empty part, even when the stream ends on a
+	// part boundary.
+	var etag *string
+	completed, err := uploadParts(ctx, svc, upload, 1, partSize, maxParts, contentMD5, br)
+	if err == nil {
+		etag, err = completeUpload(ctx, svc, upload, completed)
+	}
+	if err != nil {
+		abortUpload(svc, upload)
+	}
+	return aws.ToString(upload.uploadID), etag, err
+}
+
+// initiateUpload starts a multipart upload.
+func initiateUpload(ctx context.Context, svc multipartAPI, input *s3.CreateMultipartUploadInput) (*multipartUpload, error) {
+	var out *s3.CreateMultipartUploadOutput
+	err := retryControl(ctx, "CreateMultipartUpload", func() (err error) {
+		out, err = svc.CreateMultipartUpload(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &multipartUpload{
+		bucket:   out.Bucket,
+		key:      out.Key,
+		uploadID: out.UploadId,
+		sha256:   out.ChecksumAlgorithm == types.ChecksumAlgorithmSha256,
+	}, nil
+}
+
+// uploadParts uploads the content of r to upload in parts of partSize bytes,
+// numbered from partNumber up to at most maxParts, each with a Content-MD5 if
+// contentMD5 is set. It returns the parts it managed to upload.
+func uploadParts(ctx context.Context, svc multipartAPI, upload *multipartUpload, partNumber int32, partSize int64, maxParts int32, contentMD5 bool, r io.Reader) ([]types.CompletedPart, error) {
+	done := make(chan struct{})
+	parts, errc := chunkData(r, partSize, done)
+	defer func() {
+		// Stop chunkData, if we return early, and wait for it to,
+		// so that it doesn't go on reading r.
+		close(done)
+		for range parts {
+		}
+	}()
+
+	var (
+		completed []types.CompletedPart
+		total     int64
+	)
+	for part := range parts {
+		// S3 numbers parts from 1 and allows at most 10,000, or
+		// -max-upload-parts may allow fewer.
+		if partNumber > maxParts {
+			return completed, fmt.Errorf("stream exceeds the limit of %d parts of %d bytes", maxParts, partSize)
+		}
+
+		input := &s3.UploadPartInput{
+			Bucket:     upload.bucket,
+			Key:        upload.key,
+			UploadId:   upload.uploadID,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(part),
+		}
+		if contentMD5 {
+			// S3 checks Content-MD5 and rejects the part if it was
+			// corrupted in transit.
+			sum := md5.Sum(part)
+			input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		if upload.sha256 {
+			// S3 keeps this one, to check the parts again on
+			// completion.
+			sum := sha256.Sum256(part)
+			input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		out, err := svc.UploadPart(ctx, input)
+		if err != nil {
+			return completed, err
+		}
+
+		completed = append(completed, types.CompletedPart{
+			ETag:           out.ETag,
+			PartNumber:     aws.Int32(partNumber),
+			ChecksumSHA256: input.ChecksumSHA256,
+		})
+		total += int64(len(part))
+		debugf("Uploaded part %d: %d bytes (%d bytes total)", partNumber, len(part), total)
+		partNumber++
+	}
+
+	// chunkData closes errc after chunks, so this doesn't block.
+	return completed, <-errc
+}
+
+// completeUpload completes upload, which consists of completed, and returns
+// the object's ETag.
+func completeUpload(ctx context.Context, svc multipartAPI, upload *multipartUpload, completed []types.CompletedPart) (*string, error) {
+	// S3 requires the parts in ascending order.
+	sort.Slice(completed, func(i, j int) bool {
+		return aws.ToInt32(completed[i].PartNumber) < aws.ToInt32(completed[j].PartNumber)
+	})
+
+	var etag *string
+	err := retryControl(ctx, "CompleteMultipartUpload", func() error {
+		out, err := svc.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          upload.bucket,
+			Key:             upload.key,
+			UploadId:        upload.uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+		if err == nil {
+			etag = out.ETag
+			return nil
+		}
+		var noSuchUpload *types.NoSuchUpload
+		if errors.As(err, &noSuchUpload) {
+			if e, ok := completedEarlier(ctx, svc, upload, completed); ok {
+				// An earlier attempt succeeded but we didn't hear back.
+				etag = e
+				return nil
+			}
+		}
+		return err
+	})
+	return etag, err
+}
+
+// abortUpload aborts upload, logging any failure to do so.
+func abortUpload(svc multipartAPI, upload *multipartUpload) {
+	// Use a fresh context: ctx may be why we're aborting.
+	_, err := svc.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   upload.bucket,
+		Key:      upload.key,
+		UploadId: upload.uploadID,
+	})
+	if err != nil {
+		warnf("s3c.AbortMultipartUpload: %v", err)
+	}
+}
+
+// listParts returns the parts uploaded to upload so far, checking that they
+// are numbered from 1 without gaps. It also sets upload.sha256.
+func listParts(ctx context.Context, svc multipartAPI, upload *multipartUpload) ([]types.Part, error) {
+	var parts []types.Part
+	p := s3.NewListPartsPaginator(svc, &s3.ListPartsInput{
+		Bucket:   upload.bucket,
+		Key:      upload.key,
+		UploadId: upload.uploadID,
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, page.Parts...)
+		upload.sha256 = page.ChecksumAlgorithm == types.ChecksumAlgorithmSha256
+	}
+
+	for i, part := range parts {
+		if n := aws.ToInt32(part.PartNumber); n != int32(i+1) {
+			return nil, fmt.Errorf("upload has a gap in its parts: expected part %d, found part %d", i+1, n)
+		}
+	}
+	return parts, nil
+}
+
+// retryControl calls f until it succeeds, returns an error which isn't worth
+// retrying, or has been tried a few times. It's for the calls which start and
+// finish a multipart upload; the SDK's own retries are per request, and parts
+// are retried separately.
+func retryControl(ctx context.Context, op string, f func() error) error {
+	const attempts = 4
+	delay := time.Second
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil || i == attempts || !isRetryable(err) {
+			return err
+		}
+		warnf("%s failed (attempt %d of %d), retrying in %v: %s", op, i, attempts, delay, describeError(err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// isRetryable reports whether err is transient, by the SDK's reckoning,
+// unless it's one of the errors in errorHints, which never are.
+func isRetryable(err error) bool {
+	if _, ok := errorHints[errorCode(err)]; ok {
+		return false
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// completedEarlier reports whether upload has already been completed, by
+// checking for an object with the ETag S3 gives a multipart upload of the
+// completed parts, and returns its ETag if so.
+func completedEarlier(ctx context.Context, svc multipartAPI, upload *multipartUpload, completed []types.CompletedPart) (*string, bool) {
+	want, ok := multipartETag(completed)
+	if !ok {
+		return nil, false
+	}
+	head, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: upload.bucket,
+		Key:    upload.key,
+	})
+	if err != nil {
+		return nil, false
+	}
+	return head.ETag, aws.ToString(head.ETag) == want
+}
+
+// chunkData splits the content in r into chunks of size sz or smaller. Both
+// channels are closed when r is exhausted, after a read error is sent, or
+// once done is closed and the chunk being read is finished.
+func chunkData(r io.Reader, sz int64, done <-chan struct{}) (<-chan []byte, <-chan error) {
+	chunks := make(chan []byte, 2)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(chunks)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			buf := &bytes.Buffer{}
+			n, err := io.Copy(buf, io.LimitReader(r, sz))
+			if err != nil {
+				errc <- err
+				return
+			}
+			if n == 0 {
+				return
+			}
+			select {
+			case chunks <- buf.Bytes():
+			case <-done:
+				return
+			}
+			if n < sz {
+				// Short, so r is exhausted.
+				return
+			}
+		}
+	}()
+	return chunks, errc
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/goleak"
+)
+
+// fakeMultipart is a multipartAPI which keeps the requests it's sent.
+type fakeMultipart struct {
+	// algorithm is the ChecksumAlgorithm CreateMultipartUpload replies
+	// with.
+	algorithm types.ChecksumAlgorithm
+	// headETag is the ETag of the object HeadObject finds, if any.
+	headETag *string
+
+	mu        sync.Mutex
+	creates   int
+	created   *s3.CreateMultipartUploadInput // the last
+	parts     []*s3.UploadPartInput
+	bodies    [][]byte // of parts
+	completes []*s3.CompleteMultipartUploadInput
+	aborts    int
+}
+
+func (f *fakeMultipart) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.creates++
+	f.created = in
+	return &s3.CreateMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, UploadId: aws.String("upload-id"), ChecksumAlgorithm: f.algorithm}, nil
+}
+
+func (f *fakeMultipart) UploadPart(ctx context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	body, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.parts = append(f.parts, in)
+	f.bodies = append(f.bodies, body)
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"%x"`, md5.Sum(body)))}, nil
+}
+
+func (f *fakeMultipart) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completes = append(f.completes, in)
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(`"etag-1"`)}, nil
+}
+
+func (f *fakeMultipart) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.aborts++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeMultipart) HeadObject(ctx context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if f.headETag == nil {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ETag: f.headETag}, nil
+}
+
+func (f *fakeMultipart) ListParts(ctx context.Context, in *s3.ListPartsInput, _ ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	return &s3.ListPartsOutput{}, nil
+}
+
+// testUpload is the upload the tests complete.
+func testUpload() *multipartUpload {
+	return &multipartUpload{bucket: aws.String("bucket"), key: aws.String("key"), uploadID: aws.String("upload-id")}
+}
+
+func TestCompleteUploadSortsParts(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		order []int32
+	}{
+		{"one part", []int32{1}},
+		{"in order", []int32{1, 2, 3}},
+		{"reversed", []int32{3, 2, 1}},
+		{"shuffled", []int32{2, 5, 1, 4, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var completed []types.CompletedPart
+			for _, n := range tc.order {
+				completed = append(completed, types.CompletedPart{PartNumber: aws.Int32(n), ETag: aws.String(fmt.Sprintf(`"etag%d"`, n))})
+			}
+			svc := &fakeMultipart{}
+			etag, err := completeUpload(context.Background(), svc, testUpload(), completed)
+			if err != nil {
+				t.Fatalf("completeUpload: %v", err)
+			}
+			if aws.ToString(etag) != `"etag-1"` {
+				t.Errorf("ETag %s, want the one CompleteMultipartUpload returned", aws.ToString(etag))
+			}
+			if len(svc.completes) != 1 {
+				t.Fatalf("%d CompleteMultipartUpload requests, want 1", len(svc.completes))
+			}
+			in := svc.completes[0]
+			if aws.ToString(in.Bucket) != "bucket" || aws.ToString(in.Key) != "key" || aws.ToString(in.UploadId) != "upload-id" {
+				t.Errorf("completed %s/%s upload %s, want bucket/key upload upload-id", aws.ToString(in.Bucket), aws.ToString(in.Key), aws.ToString(in.UploadId))
+			}
+			if in.MultipartUpload == nil || len(in.MultipartUpload.Parts) != len(tc.order) {
+				t.Fatalf("the request has %+v, want %d parts", in.MultipartUpload, len(tc.order))
+			}
+			for i, p := range in.MultipartUpload.Parts {
+				n := int32(i + 1)
+				if aws.ToInt32(p.PartNumber) != n {
+					t.Errorf("part %d of the request is part number %d, want %d", i, aws.ToInt32(p.PartNumber), n)
+				}
+				if want := fmt.Sprintf(`"etag%d"`, n); aws.ToString(p.ETag) != want {
+					t.Errorf("part %d has ETag %s, want %s", n, aws.ToString(p.ETag), want)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadStreamChecksums(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		algorithm types.ChecksumAlgorithm
+	}{
+		{"SHA256", types.ChecksumAlgorithmSha256},
+		{"none", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &fakeMultipart{algorithm: tc.algorithm}
+			input := &s3.CreateMultipartUploadInput{Bucket: aws.String("bucket"), Key: aws.String("key"), ChecksumAlgorithm: tc.algorithm}
+			_, _, err := uploadStream(context.Background(), svc, input, 4, manager.MaxUploadParts, true, strings.NewReader("0123456789"))
+			if err != nil {
+				t.Fatalf("uploadStream: %v", err)
+			}
+			if len(svc.parts) != 3 || len(svc.completes) != 1 {
+				t.Fatalf("%d parts and %d completions, want 3 and 1", len(svc.parts), len(svc.completes))
+			}
+			completed := svc.completes[0].MultipartUpload.Parts
+			for i, in := range svc.parts {
+				want := ""
+				if tc.algorithm == types.ChecksumAlgorithmSha256 {
+					sum := sha256.Sum256(svc.bodies[i])
+					want = base64.StdEncoding.EncodeToString(sum[:])
+				}
+				if got := aws.ToString(in.ChecksumSHA256); got != want {
+					t.Errorf("part %d has ChecksumSHA256 %q, want %q", i+1, got, want)
+				}
+				if got := aws.ToString(completed[i].ChecksumSHA256); got != want {
+					t.Errorf("the completion has ChecksumSHA256 %q for part %d, want %q", got, i+1, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadStreamPartBoundaries(t *testing.T) {
+	const partSize = 4
+	for _, tc := range []struct {
+		name  string
+		size  int
+		parts []int // their sizes
+	}{
+		{"empty", 0, nil},
+		{"short of a part", 3, []int{3}},
+		{"one part exactly", 4, []int{4}},
+		{"two parts exactly", 8, []int{4, 4}},
+		{"just over two parts", 9, []int{4, 4, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &fakeMultipart{}
+			input := &s3.CreateMultipartUploadInput{Bucket: aws.String("bucket"), Key: aws.String("key")}
+			_, _, err := uploadStream(context.Background(), svc, input, partSize, manager.MaxUploadParts, true, strings.NewReader(strings.Repeat("x", tc.size)))
+			if tc.size == 0 {
+				if !errors.Is(err, errEmptyStream) {
+					t.Errorf("uploadStream returned %v, want errEmptyStream", err)
+				}
+				if svc.creates != 0 {
+					t.Errorf("an upload was created for an empty stream")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("uploadStream: %v", err)
+			}
+			var sizes []int
+			for _, b := range svc.bodies {
+				sizes = append(sizes, len(b))
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(tc.parts) {
+				t.Errorf("uploaded parts of %v bytes, want %v", sizes, tc.parts)
+			}
+			if n := len(svc.completes[0].MultipartUpload.Parts); n != len(tc.parts) {
+				t.Errorf("completed %d parts, want %d", n, len(tc.parts))
+			}
+		})
+	}
+}
+
+func TestUploadPartsContentMD5(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		contentMD5 bool
+	}{
+		{"with Content-MD5", true},
+		{"-disable-content-md5", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &fakeMultipart{}
+			_, err := uploadParts(context.Background(), svc, testUpload(), 1, 4, manager.MaxUploadParts, tc.contentMD5, strings.NewReader("0123456789"))
+			if err != nil {
+				t.Fatalf("uploadParts: %v", err)
+			}
+			for i, in := range svc.parts {
+				want := ""
+				if tc.contentMD5 {
+					sum := md5.Sum(svc.bodies[i])
+					want = base64.StdEncoding.EncodeToString(sum[:])
+				}
+				if got := aws.ToString(in.ContentMD5); got != want {
+					t.Errorf("part %d has Content-MD5 %q, want %q", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadPartsMaxParts(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		partNumber int32 // the first
+		maxParts   int32
+		size       int
+		wantErr    bool
+	}{
+		{"within the limit", 1, 3, 12, false},
+		{"over the limit", 1, 2, 12, true},
+		// chunkData has more parts to send when uploadParts gives up.
+		{"well over the limit", 1, 2, 40, true},
+		{"resumed within the limit", 3, 5, 12, false},
+		{"resumed over the limit", 3, 4, 12, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+			svc := &fakeMultipart{}
+			completed, err := uploadParts(context.Background(), svc, testUpload(), tc.partNumber, 4, tc.maxParts, true, strings.NewReader(strings.Repeat("x", tc.size)))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("uploadParts returned %v, want an error: %v", err, tc.wantErr)
+			}
+			for _, p := range completed {
+				if n := aws.ToInt32(p.PartNumber); n > tc.maxParts {
+					t.Errorf("uploaded part %d, more than %d", n, tc.maxParts)
+				}
+			}
+		})
+	}
+}
+
+func TestCompletedEarlier(t *testing.T) {
+	// Two parts, "a" and "b"; the object's ETag is the MD5 of their MD5s.
+	sumA, sumB := md5.Sum([]byte("a")), md5.Sum([]byte("b"))
+	completed := []types.CompletedPart{
+		{PartNumber: aws.Int32(1), ETag: aws.String(fmt.Sprintf(`"%x"`, sumA))},
+		{PartNumber: aws.Int32(2), ETag: aws.String(fmt.Sprintf(`"%x"`, sumB))},
+	}
+	etag := fmt.Sprintf(`"%x-2"`, md5.Sum(append(sumA[:], sumB[:]...)))
+	for _, tc := range []struct {
+		name      string
+		completed []types.CompletedPart
+		headETag  *string
+		want      bool
+	}{
+		{"completed", completed, aws.String(etag), true},
+		{"no object", completed, nil, false},
+		{"another object with as many parts", completed, aws.String(`"0123456789abcdef0123456789abcdef-2"`), false},
+		{"a single part object", completed, aws.String(fmt.Sprintf(`"%x"`, sumA)), false},
+		{"parts whose ETags aren't MD5s", []types.CompletedPart{{PartNumber: aws.Int32(1), ETag: aws.String(`"kms"`)}}, aws.String(`"kms-1"`), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &fakeMultipart{headETag: tc.headETag}
+			got, ok := completedEarlier(context.Background(), svc, testUpload(), tc.completed)
+			if ok != tc.want {
+				t.Fatalf("completedEarlier reported %v, want %v", ok, tc.want)
+			}
+			if ok && aws.ToString(got) != etag {
+				t.Errorf("ETag %s, want %s", aws.ToString(got), etag)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// notifyTimeout bounds how long sending notifications can hold up exiting.
+const notifyTimeout = 30 * time.Second
+
+// notification is the JSON message sent by -notify-sns-arn and
+// -notify-webhook-url.
+type notification struct {
+	Result       string   `json:"result"` // success or failure
+	ExitCode     int      `json:"exit_code"`
+	Error        string   `json:"error,omitempty"`
+	Destinations []string `json:"destinations"`
+	JobID        string   `json:"job_id,omitempty"`
+}
+
+// notifier sends notifications of how the run went.
+type notifier struct {
+	sns        *sns.Client
+	topicARN   string
+	webhookURL string
+}
+
+// send publishes n to the SNS topic and POSTs it to the webhook, whichever
+// are configured.
+func (nt *notifier) send(n notification) error {
+	msg, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	var errs []error
+	if nt.topicARN != "" {
+		_, err := nt.sns.Publish(ctx, &sns.PublishInput{
+			TopicArn: aws.String(nt.topicARN),
+			Message:  aws.String(string(msg)),
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SNS: %w", err))
+		}
+	}
+	if nt.webhookURL != "" {
+		if err := postJSON(ctx, nt.webhookURL, msg); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func postJSON(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
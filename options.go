@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// options are cmd2s3's flags.
+type options struct {
+	download bool
+	gunzip   bool
+	spoolTo  string
+	untarDir string
+
+	initiateOnly   bool
+	resumeUploadID string
+	resumeID       string
+	resumeFrom     int
+	completeID     string
+
+	copyFrom          string
+	metadataDirective string
+
+	stdinFile    string
+	inputFD      int
+	serveSocket  string
+	serveMaxJobs int
+
+	destFromFirstLine bool
+	strictKeys        bool
+	templateKeys      bool
+	uniqueSuffix      bool
+	randSeed          uint64
+	destinationsFile  string
+
+	waitAvail  time.Duration
+	verify     bool
+	verifyETag bool
+	heartbeat  time.Duration
+	timeout    time.Duration
+	deadline   string
+
+	killTimeout   time.Duration
+	combineOutput bool
+
+	progressJSON bool
+
+	teeFilename      string
+	teeFsync         bool
+	teeFsyncInterval time.Duration
+
+	checksumStdout bool
+	writeSums      string
+
+	printURLFormat string
+
+	presignExpiry time.Duration
+
+	sse              string
+	sseKMSKeyID      string
+	sseKMSKeyAlias   string
+	bucketKeyEnabled bool
+
+	assumeRole  string
+	dualStack   bool
+	stsRegional bool
+
+	notifySNS    string
+	notifyURL    string
+	strictNotify bool
+
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	retryJitter    float64
+
+	jobID string
+
+	cleanupStale time.Duration
+	cleanupOnly  bool
+	listUploads  bool
+
+	uploadIDFile string
+	logUploadIDs bool
+
+	compress               string
+	compressLevel          string
+	uncompressedLengthMeta bool
+
+	contentType     string
+	websiteRedirect string
+	contentLanguage string
+	metadataFromEnv string
+	mimeTypes       string
+	autoType        bool
+
+	skipEmpty      bool
+	forceMultipart bool
+
+	disableContentMD5 bool
+
+	shell string
+
+	execClearEnv bool
+	workdir      string
+
+	preCommand  string
+	postCommand string
+	postAlways  bool
+
+	legalHoldAfter bool
+
+	skipUnchanged bool
+
+	uploadPartial bool
+
+	redactKey           bool
+	logFileName         string
+	concurrency         int
+	maxFiles            int
+	rampUpWindow        time.Duration
+	totalConcurrency    int
+	partSize            byteSize
+	profilePreset       string
+	expectedSize        byteSize
+	maxParts            int
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+	readBufferSize      byteSize
+	successCodes        exitCodes
+	readRetries         int
+	maxLines            int64
+	coalesce            byteSize
+	noColor             bool
+	configFile          string
+	dumpCfg             bool
+	progressFD          int
+	errorFD             int
+	execEnv             envList
+	alsoCommands        stringList
+}
+
+// newOptions defines cmd2s3's flags in fs, and returns where they're parsed
+// into. -verbose sets verbose.
+func newOptions(fs *flag.FlagSet) *options {
+	o := &options{partSize: 128 << 20, readBufferSize: 1 << 20, successCodes: exitCodes{0}}
+	fs.BoolVar(&o.download, "download", false, "download the object and stream it to the command's stdin")
+	fs.BoolVar(&o.gunzip, "gunzip", false, "with -download or -untar, decompress the object with gzip")
+	fs.StringVar(&o.spoolTo, "download-to-file", "", "with -download, first download the object to this `file`, resuming with ranged GETs\nif the connection drops, then stream the file to the command. The file is left in place")
+	fs.StringVar(&o.untarDir, "untar", "", "download the object, a tar archive, and extract it into this `directory`,\ninstead of running a command")
+
+	fs.BoolVar(&o.initiateOnly, "initiate-only", false, "start a multipart upload, print its UploadId and exit without running a command")
+	fs.StringVar(&o.resumeUploadID, "upload-id", "", "upload the command's output as more parts of this multipart upload, without completing it")
+	fs.StringVar(&o.resumeID, "resume-upload-id", "", "continue this multipart upload with the command's output and complete it. The command\nmust carry on from where the upload got to: $CMD2S3_RESUME_OFFSET bytes in, which is the\nstart of part $CMD2S3_RESUME_PART")
+	fs.IntVar(&o.resumeFrom, "resume-from-part", 0, "with -resume-upload-id, replace the parts from this one on (default: after the last part)")
+	fs.StringVar(&o.completeID, "complete", "", "complete the multipart upload with this `UploadId` from the parts uploaded so far")
+
+	fs.StringVar(&o.copyFrom, "copy-from", "", "copy this s3 URL to the destination instead of running a command")
+	fs.StringVar(&o.metadataDirective, "metadata-directive", string(types.MetadataDirectiveCopy), "with -copy-from, COPY the source's metadata or REPLACE it")
+
+	fs.StringVar(&o.stdinFile, "stdin", "", "upload what's read from this file or FIFO (- for cmd2s3's standard input)\ninstead of running a command")
+	fs.IntVar(&o.inputFD, "input-fd", -1, "like -stdin, but upload what's read from this inherited file descriptor, e.g. 3,\nkeeping the data apart from cmd2s3's standard input")
+	fs.StringVar(&o.serveSocket, "serve", "", "listen on this unix `socket` for jobs, each a line of JSON, {\"command\", \"destination\"}, and\nrun them, sharing one S3 client, replying to each with {\"exit_code\", \"message\", \"location\",\n\"etag\", \"bytes\"}. The flags about the upload and the command apply to every job; -timeout\nis for each. SIGTERM stops it once the jobs in progress are done")
+	fs.IntVar(&o.serveMaxJobs, "serve-max-jobs", 4, "with -serve, run at most this many jobs at once, between all the connections;\nthe others wait their turn")
+
+	fs.BoolVar(&o.destFromFirstLine, "dest-from-first-line", false, "upload to the s3 URL the command writes as the first line of its output;\nthe rest of the output is the object")
+	fs.BoolVar(&o.strictKeys, "strict-keys", false, "reject keys which are empty, longer than 1024 bytes, not UTF-8, or which contain\ncontrol characters, a leading /, or . or .. path segments")
+	fs.BoolVar(&o.templateKeys, "template-keys", false, "expand destination keys as Go templates; {{.CommandHash}} is a hash of the\ncommand, {{.Now}} the start time, e.g. {{.Now.Format \"2006-01-02\"}}, and {{.Rand}} a random suffix")
+	fs.BoolVar(&o.uniqueSuffix, "unique-suffix", false, "append -{{.Rand}}, 16 random characters, to each destination key, so that concurrent\nruns never write to the same key")
+	fs.Uint64Var(&o.randSeed, "rand-seed", 0, "make {{.Rand}} and -unique-suffix repeatable by seeding them with this number, e.g. in tests")
+	fs.StringVar(&o.destinationsFile, "destinations-file", "", "also upload to the s3 URLs listed in this file, one per line")
+
+	fs.DurationVar(&o.waitAvail, "wait-available", 0, "once uploaded, poll HeadObject for up to this long until each object can be seen,\nfor eventually consistent stores")
+	fs.BoolVar(&o.verify, "verify", false, "check the uploaded object's size and ETag with HeadObject")
+	fs.BoolVar(&o.verifyETag, "verify-etag", false, "check the ETag S3 returns for the upload against the MD5 of the data, or for a\nmultipart upload, the MD5 of its parts' MD5s and the number of parts; skipped with SSE-KMS")
+	fs.DurationVar(&o.heartbeat, "heartbeat", 0, "log how much has been uploaded at this interval, so watchdogs can see progress")
+	fs.DurationVar(&o.timeout, "timeout", 0, "give up if the command and upload take longer than this (0 means no limit)")
+	fs.StringVar(&o.deadline, "deadline", "", "at this RFC 3339 `time`, e.g. 2026-01-02T03:00:00Z, stop the command and abort the upload\nwhatever it's doing, and exit with status 7; if that takes more than 5s, just exit")
+
+	fs.DurationVar(&o.killTimeout, "kill-timeout", 0, "when stopping the command, on -timeout or a signal, give it this long to exit after SIGTERM\n(or the signal) before killing it. By default, -timeout kills it straight away")
+	fs.BoolVar(&o.combineOutput, "combine-output", false, "upload the command's stderr too, interleaved with its stdout through one pipe. Commands\nusually buffer stdout but not stderr, so the two may not be in the order they were printed")
+
+	fs.BoolVar(&o.progressJSON, "progress-json", false, "write a JSON object of the bytes uploaded, seconds elapsed and bytes per second\nto stderr every -heartbeat interval (default 1s)")
+
+	fs.StringVar(&o.teeFilename, "tee", "", "also write what's uploaded to this local `file`")
+	fs.BoolVar(&o.teeFsync, "tee-fsync", false, "with -tee, fsync the file once it's complete, so the copy survives a crash")
+	fs.DurationVar(&o.teeFsyncInterval, "tee-fsync-interval", 0, "with -tee, also fsync the file at this interval")
+
+	fs.BoolVar(&o.checksumStdout, "checksum-stdout", false, "on success, print the SHA-256 of each object in sha256sum(1) format: <sha256>  <key>")
+	fs.StringVar(&o.writeSums, "write-sums", "", "once every destination is uploaded, upload the SHA-256 of each, in sha256sum(1) format,\nto this s3 URL, e.g. s3://bucket/SHA256SUMS")
+
+	fs.StringVar(&o.printURLFormat, "print-url-format", "", "on success, print a URL for each object: virtual (https://bucket.s3.region.amazonaws.com/key),\npath (https://s3.region.amazonaws.com/bucket/key) or console (its page in the AWS console)")
+
+	fs.DurationVar(&o.presignExpiry, "presign-expiry", 0, "on success, print a presigned GET URL for each object, valid for this long (at most 168h)")
+
+	fs.StringVar(&o.sse, "sse", string(types.ServerSideEncryptionAes256), "server-side encryption: AES256 or aws:kms")
+	fs.StringVar(&o.sseKMSKeyID, "sse-kms-key-id", "", "KMS key to use with -sse aws:kms (default: the AWS managed key)")
+	fs.StringVar(&o.sseKMSKeyAlias, "sse-kms-key-alias", "", "KMS key to use with -sse aws:kms, by its alias/name or alias ARN, which S3 resolves\nwhen uploading; the caller needs kms:GenerateDataKey and kms:Decrypt on the key")
+	fs.BoolVar(&o.bucketKeyEnabled, "bucket-key-enabled", false, "use an S3 Bucket Key with -sse aws:kms to reduce KMS request costs")
+
+	fs.StringVar(&o.assumeRole, "assume-role", "", "assume the IAM role with this `ARN` for all S3 requests")
+	fs.BoolVar(&o.dualStack, "dualstack", false, "use S3's dual-stack endpoints, which are reachable over IPv6")
+	fs.BoolVar(&o.stsRegional, "sts-regional-endpoint", false, "with -assume-role, insist on the STS endpoint for the configured region, never the\nglobal one. With private DNS, an STS interface VPC endpoint then serves the requests")
+
+	fs.StringVar(&o.notifySNS, "notify-sns-arn", "", "when finished, publish a JSON message saying how it went to this SNS topic")
+	fs.StringVar(&o.notifyURL, "notify-webhook-url", "", "when finished, POST a JSON message saying how it went to this URL")
+	fs.BoolVar(&o.strictNotify, "strict-notify", false, "exit non-zero if a notification can't be sent, even if the upload succeeded")
+
+	fs.DurationVar(&o.retryBaseDelay, "retry-base-delay", time.Second, "wait up to this long before retrying a failed S3 request, doubling for each retry after that")
+	fs.DurationVar(&o.retryMaxDelay, "retry-max-delay", 20*time.Second, "wait at most this long between retries of an S3 request")
+	fs.Float64Var(&o.retryJitter, "retry-jitter", 1, "wait a random fraction less, between 0 and this, so clients don't retry in step;\n1 waits anywhere up to the delay, 0 waits the full delay")
+
+	fs.StringVar(&o.jobID, "job-id", "", "add cmd2s3-job/`ID` to the User-Agent of every S3 request, to find them in access logs")
+
+	fs.DurationVar(&o.cleanupStale, "cleanup-stale", 0, "first abort multipart uploads to keys starting with each destination's key\nwhich were initiated longer ago than this")
+	fs.BoolVar(&o.cleanupOnly, "cleanup-only", false, "with -cleanup-stale, only clean up; don't run a command")
+	fs.BoolVar(&o.listUploads, "list-multipart", false, "list the multipart uploads in progress to keys starting with each destination's key,\nwith their UploadIds and when they were initiated; don't run a command")
+
+	fs.StringVar(&o.uploadIDFile, "upload-id-output-file", "", "write the multipart UploadId to this file as soon as the upload is initiated")
+	fs.BoolVar(&o.logUploadIDs, "log-upload-id", false, "log the multipart UploadId as soon as the upload is initiated")
+
+	fs.StringVar(&o.compress, "compress", "", "compress the command's output before uploading it; the only method is gzip,\nwhich also sets Content-Encoding: gzip. auto is gzip unless the output starts\nlike something compressed already, e.g. a gzip, zip, PNG or JPEG file")
+	fs.StringVar(&o.compressLevel, "compress-level", "", "with -compress, the gzip level from 1 (fastest) to 9 (smallest), or auto to start at 6\nand, best-effort, go lower while compressing is what holds up the upload. auto may\nwrite several gzip members one after another, which gunzip reads as one (default 6)")
+	fs.BoolVar(&o.uncompressedLengthMeta, "uncompressed-length-metadata", false, "with -compress, record the size of the command's output in x-amz-meta-uncompressed-length,\nby copying the object onto itself once it's uploaded")
+
+	fs.StringVar(&o.contentType, "content-type", "", "Content-Type of the object")
+	fs.StringVar(&o.websiteRedirect, "website-redirect-location", "", "make the object a website redirect to this path (starting with /) or http(s) URL")
+	fs.StringVar(&o.contentLanguage, "content-language", "", "Content-Language of the object, e.g. en-GB")
+	fs.StringVar(&o.metadataFromEnv, "metadata-from-env", "", "record these comma separated environment variables, as the command sees them,\nin x-amz-meta-<name> metadata")
+	fs.StringVar(&o.mimeTypes, "mime-types", "", "like -auto-content-type, but look the key's extension up in this mime.types file first")
+	fs.BoolVar(&o.autoType, "auto-content-type", false, "where there's no -content-type, infer it from the key's extension (the last one,\nor the one before .gz with -compress gzip), then the content, then application/octet-stream")
+
+	fs.BoolVar(&o.skipEmpty, "skip-empty", false, "if the output is empty, upload nothing rather than an empty object")
+	fs.BoolVar(&o.forceMultipart, "force-multipart", false, "always use a multipart upload, one part at a time, even for output smaller than a part.\nFor gateways such as Google Cloud Storage's XML API and Backblaze B2, which don't support\naws-chunked encoding, or those that answer a streamed PutObject with 411 Length Required")
+
+	fs.BoolVar(&o.disableContentMD5, "disable-content-md5", false, "only send integrity checksums (Content-MD5, x-amz-checksum-*) when S3 requires them,\nfor gateways such as older Ceph RGW and MinIO releases that reject them")
+
+	fs.StringVar(&o.shell, "shell", defaultShell, "run the command with this interpreter and its arguments, e.g. \"bash -c\"")
+
+	fs.BoolVar(&o.execClearEnv, "exec-clear-env", false, "don't pass cmd2s3's environment on to the command; only -exec-env variables are set")
+	fs.StringVar(&o.workdir, "workdir", "", "run the command in this directory")
+
+	fs.StringVar(&o.preCommand, "pre-command", "", "first run this shell command, and give up if it fails")
+	fs.StringVar(&o.postCommand, "post-command", "", "once the command has run and its output is uploaded, run this shell command.\nIts environment has CMD2S3_EXIT_CODE, the exit code cmd2s3 would otherwise use")
+	fs.BoolVar(&o.postAlways, "post-always", false, "run -post-command even if something failed, as long as -pre-command succeeded")
+
+	fs.BoolVar(&o.legalHoldAfter, "apply-legal-hold-after", false, "once the object is uploaded (and verified), turn on its Object Lock legal hold")
+
+	fs.BoolVar(&o.skipUnchanged, "skip-if-unchanged", false, "save the output to a temporary file first, and don't upload it to objects whose\nx-amz-meta-sha256 is its SHA-256 already; it's stored there for next time")
+
+	fs.BoolVar(&o.uploadPartial, "upload-partial-on-failure", false, "if the command fails, keep what it wrote instead of aborting the upload,\nand tag the object with how the command failed, e.g. cmd2s3-command-failed=exit status 1.\nCharacters S3 doesn't allow in a tag become _, and it's cut to 256 characters")
+
+	fs.BoolVar(&o.redactKey, "redact-key", false, "show object keys in log messages, -error-fd and notifications as <redacted:…>,\na short hash of the key, e.g. s3://bucket/<redacted:ab12cd>")
+	fs.StringVar(&o.logFileName, "log-file", "", "append cmd2s3's own log messages to this file instead of stderr")
+	fs.IntVar(&o.concurrency, "concurrency", 4, "parts to upload at once, per destination")
+	fs.IntVar(&o.maxFiles, "max-concurrent-files", 16, "stream the output to at most this many destinations at once; the rest are copied\nfrom the first destination by S3 once it's uploaded, this many at a time")
+	fs.DurationVar(&o.rampUpWindow, "ramp-up", 0, "start by uploading one part at a time, and allow more evenly over this long until\nthe full concurrency, so that many cmd2s3s starting together don't stampede")
+	fs.IntVar(&o.totalConcurrency, "total-concurrency", 0, "if set, share this many concurrent part uploads between all destinations,\noverriding -concurrency. Memory use is roughly\ndestinations * (concurrency per destination + 1) * part size")
+	fs.Var(&o.partSize, "part-size", "`size` of each part of a multipart upload; at most 10,000 parts are allowed")
+	fs.StringVar(&o.profilePreset, "profile-preset", "", "set -part-size and -concurrency, where they aren't given, from a preset:\n"+presetHelp())
+	fs.Var(&o.expectedSize, "expected-size", "roughly how big the output will be; unless -part-size is given, choose a part size\nwhich suits that `size`")
+	fs.IntVar(&o.maxParts, "max-upload-parts", int(maxUploadParts), "most parts to upload; with -part-size, this limits the size of the object to\nmax-upload-parts * part-size, e.g. 10000 * 128MiB = 1.22TiB. S3 allows at most 10000")
+	fs.IntVar(&o.maxIdleConns, "max-idle-conns", awshttp.DefaultHTTPTransportMaxIdleConns, "idle HTTP connections to keep for reuse")
+	fs.IntVar(&o.maxIdleConnsPerHost, "max-idle-conns-per-host", awshttp.DefaultHTTPTransportMaxIdleConnsPerHost, "idle HTTP connections to keep for reuse per host;\nraise this to at least the total concurrency with many concurrent parts")
+	fs.IntVar(&o.maxConnsPerHost, "max-conns-per-host", 0, "most HTTP connections to open to each host (0 means no limit)")
+	fs.DurationVar(&o.idleConnTimeout, "idle-conn-timeout", awshttp.DefaultHTTPTransportIdleConnTimeout, "close HTTP connections which have been idle for this long")
+	fs.Var(&o.readBufferSize, "read-buffer-size", "with -compress, read the command's output through a buffer of this `size` (0 for none),\nrather than in the 32KiB pieces gzip takes")
+	fs.Var(&o.successCodes, "success-exit-codes", "the command's exit `statuses` which count as success, e.g. 0,1 for diff(1);\nany other aborts the upload")
+	fs.IntVar(&o.readRetries, "read-retries", 0, "retry a read of the command's output which fails with EINTR, EAGAIN or the like up to this\nmany times in a row. Only for errors reading the pipe: the command failing is never retried")
+	fs.Int64Var(&o.maxLines, "max-lines", 0, "abort the upload, with exit status 4, once the output has more than this many lines;\na coarse guard against a command stuck in a loop (0 for no limit)")
+	fs.Var(&o.coalesce, "coalesce-reads", "collect the command's output into reads of this `size` before passing it on,\nfor commands that write in small bursts")
+	fs.BoolVar(&o.noColor, "no-color", false, "don't colour log messages, even when stderr is a terminal")
+	fs.StringVar(&o.configFile, "config", "", "read defaults for these flags from this YAML `file` (default ~/.cmd2s3.yaml, if it exists);\nflags on the command line take precedence. It may also set region and endpoint, for S3,\nunless AWS_REGION or AWS_ENDPOINT_URL_S3 are set")
+	fs.BoolVar(&o.dumpCfg, "dump-config", false, "print the settings that would be used, with secrets redacted, as JSON and exit")
+	fs.IntVar(&o.progressFD, "progress-fd", -1, "write -progress-json or -heartbeat progress to this file descriptor instead of stderr")
+	fs.IntVar(&o.errorFD, "error-fd", -1, "on failure, also write the error as a line of JSON to this file descriptor, e.g. 3:\n{\"exit_code\", \"message\", \"aws_error_code\", \"retryable\"}")
+	fs.BoolVar(&verbose, "verbose", false, "log more detail about what's going on, including each retry of an S3 request and why")
+	fs.Var(&o.execEnv, "exec-env", "set `KEY=VALUE` in the command's environment (repeatable)")
+	fs.Var(&o.alsoCommands, "also-command", "once the command has finished, run this shell `command` too and upload its output\nafter the command's, as part of the same object (repeatable, in order)")
+	return o
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+// maxUploadParts is the most parts S3 allows in a multipart upload.
+const maxUploadParts = int64(manager.MaxUploadParts)
+
+// maxPartSize is the largest part S3 allows.
+const maxPartSize = 5 << 30
+
+// preset is a -profile-preset: a part size and concurrency which go
+// together.
+type preset struct {
+	partSize    int64
+	concurrency int
+	about       string
+}
+
+// presetNames are the -profile-presets, in order.
+var presetNames = []string{"low-memory", "balanced", "high-throughput"}
+
+var presets = map[string]preset{
+	"low-memory": {8 << 20, 2, "8MiB parts, 2 at a time: about 24MiB of memory per destination,\n" +
+		"objects up to 78GiB, and the throughput of about 2 connections"},
+	"balanced": {64 << 20, 4, "64MiB parts, 4 at a time: about 320MiB per destination,\n" +
+		"objects up to 625GiB, and the throughput of about 4 connections"},
+	"high-throughput": {128 << 20, 16, "128MiB parts, 16 at a time: about 2.1GiB per destination,\n" +
+		"objects up to 1.22TiB, and the throughput of about 16 connections, for fast networks"},
+}
+
+// presetHelp describes the presets for -help.
+func presetHelp() string {
+	var b strings.Builder
+	for _, name := range presetNames {
+		fmt.Fprintf(&b, "%s: %s\n", name, presets[name].about)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// availableMemory returns about how much memory cmd2s3 can use before it
+// runs out, going by /proc/meminfo and a cgroup v2 memory limit, or 0 if
+// that's not known, e.g. other than on Linux.
+func availableMemory() int64 {
+	var avail int64
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if v, ok := strings.CutPrefix(s.Text(), "MemAvailable:"); ok {
+				kib, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(v, "kB")), 10, 64)
+				avail = kib << 10
+			}
+		}
+		f.Close()
+	}
+	max, err := os.ReadFile("/sys/fs/cgroup/memory.max")
+	if err != nil {
+		return avail
+	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(string(max)), 10, 64)
+	if err != nil {
+		// "max", meaning no limit.
+		return avail
+	}
+	if cur, err := os.ReadFile("/sys/fs/cgroup/memory.current"); err == nil {
+		used, _ := strconv.ParseInt(strings.TrimSpace(string(cur)), 10, 64)
+		limit -= used
+	}
+	if avail == 0 || limit < avail {
+		return limit
+	}
+	return avail
+}
+
+// partSizeFor returns the smallest part size of at least partSize which
+// allows an object of size bytes to be uploaded within manager.MaxUploadParts
+// parts.
+func partSizeFor(size, partSize int64) int64 {
+	if min := (size + maxUploadParts - 1) / maxUploadParts; min > partSize {
+		return min
+	}
+	return partSize
+}
+
+// partSizeForExpected returns a part size for an upload expected to be about
+// size bytes: big enough for twice that, in case it's an underestimate, but
+// no bigger, to save memory. It's a whole number of MiB.
+func partSizeForExpected(size int64) int64 {
+	const mib = 1 << 20
+	partSize := partSizeFor(2*size, manager.MinUploadPartSize)
+	return (partSize + mib - 1) / mib * mib
+}
+
+// partLimitWarner logs a warning once the stream read through it gets close
+// to the largest object that can be uploaded in maxParts parts of partSize.
+// For streams of unknown size that's better than only finding out at the end.
+type partLimitWarner struct {
+	io.Reader
+	partSize int64
+	maxParts int64
+	n        int64
+	warned   bool
+}
+
+func (w *partLimitWarner) Read(p []byte) (int, error) {
+	n, err := w.Reader.Read(p)
+	w.n += int64(n)
+	limit := w.partSize * w.maxParts
+	if !w.warned && w.n > limit/10*9 {
+		w.warned = true
+		warnf("%d bytes read, the upload will fail after %d bytes (%d parts of %d bytes); use a larger -part-size",
+			w.n, limit, w.maxParts, w.partSize)
+	}
+	return n, err
+}
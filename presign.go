@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxPresignExpiry is the longest expiry SigV4 allows.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// presignGet returns a URL which can be used to GET d until expiry elapses.
+func presignGet(ctx context.Context, svc *s3.Client, d destination, expiry time.Duration) (string, error) {
+	creds, err := svc.Options().Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+	if creds.AccessKeyID == "" {
+		return "", errors.New("can't presign a URL with anonymous credentials")
+	}
+
+	req, err := s3.NewPresignClient(svc).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: d.bucket,
+		Key:    d.key,
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// startHeartbeat logs how many bytes have been read through counter to logger
+// every interval, so that supervisors watching the log can see the upload is
+// alive. It stops when the returned function is called.
+func startHeartbeat(logger *log.Logger, interval time.Duration, counter *countingReader) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logger.Printf("Still uploading, %d bytes so far", counter.n.Load())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// progressEvent is a line of -progress-json output.
+type progressEvent struct {
+	Bytes   int64   `json:"bytes"`
+	Elapsed float64 `json:"elapsed"` // seconds
+	Rate    float64 `json:"rate"`    // bytes per second
+}
+
+// startProgressJSON writes a progressEvent to w every interval, and one more
+// when the returned function is called to stop it.
+func startProgressJSON(w io.Writer, interval time.Duration, counter *countingReader) (stop func()) {
+	start := time.Now()
+	emit := func() {
+		ev := progressEvent{Bytes: counter.n.Load(), Elapsed: time.Since(start).Seconds()}
+		if ev.Elapsed > 0 {
+			ev.Rate = float64(ev.Bytes) / ev.Elapsed
+		}
+		b, _ := json.Marshal(ev)
+		fmt.Fprintf(w, "%s\n", b)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				emit()
+			case <-done:
+				emit()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
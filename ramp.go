@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// rampUp limits how many UploadPart requests can be in progress at once,
+// starting at 1 and rising evenly to max over window, for -ramp-up. When
+// many cmd2s3s start together, e.g. from cron, this stops them all opening
+// every connection at once.
+type rampUp struct {
+	slots chan struct{}
+}
+
+// newRampUp returns a rampUp which reaches max after window.
+func newRampUp(max int, window time.Duration) *rampUp {
+	r := &rampUp{slots: make(chan struct{}, max)}
+	r.slots <- struct{}{}
+	go func() {
+		for i := 1; i < max; i++ {
+			time.Sleep(window / time.Duration(max-1))
+			r.slots <- struct{}{}
+		}
+	}()
+	return r
+}
+
+// middleware holds each UploadPart until there's a slot for it.
+func (r *rampUp) middleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RampUp", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		if _, ok := in.Parameters.(*s3.UploadPartInput); !ok {
+			return next.HandleInitialize(ctx, in)
+		}
+		select {
+		case <-r.slots:
+		case <-ctx.Done():
+			return middleware.InitializeOutput{}, middleware.Metadata{}, ctx.Err()
+		}
+		defer func() { r.slots <- struct{}{} }()
+		return next.HandleInitialize(ctx, in)
+	}), middleware.Before)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// redactor is set by -redact-key.
+var redactor *keyRedactor
+
+// keyRedactor replaces object keys in what's written through it with
+// <redacted:…>, a short hash of the key, so that keys can be told apart in
+// logs without being given away.
+type keyRedactor struct {
+	w io.Writer
+
+	mu   sync.Mutex
+	repl map[string]string
+	r    *strings.Replacer
+}
+
+// add redacts key from now on, as written after a / in a URL, escaped or
+// not, or quoted.
+func (k *keyRedactor) add(key string) {
+	if key == "" {
+		return
+	}
+	sum := sha256.Sum256([]byte(key))
+	label := "<redacted:" + hex.EncodeToString(sum[:3]) + ">"
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.repl == nil {
+		k.repl = map[string]string{}
+	}
+	k.repl[strconv.Quote(key)] = `"` + label + `"`
+	for _, f := range []string{key, escapeKey(key), url.PathEscape(key)} {
+		k.repl["/"+f] = "/" + label
+	}
+
+	// The longest match wins, so a key isn't partly replaced by a shorter
+	// key which is a prefix of it.
+	old := slices.Collect(maps.Keys(k.repl))
+	slices.SortFunc(old, func(a, b string) int { return len(b) - len(a) })
+	oldnew := make([]string, 0, 2*len(old))
+	for _, o := range old {
+		oldnew = append(oldnew, o, k.repl[o])
+	}
+	k.r = strings.NewReplacer(oldnew...)
+}
+
+// redact returns s with the keys replaced.
+func (k *keyRedactor) redact(s string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.r == nil {
+		return s
+	}
+	return k.r.Replace(s)
+}
+
+func (k *keyRedactor) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(k.w, k.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redacted is s with the keys replaced, if -redact-key is given.
+func redacted(s string) string {
+	if redactor == nil {
+		return s
+	}
+	return redactor.redact(s)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+// serveJob is a job sent to -serve: run command, and upload its output to
+// destination, an s3 URL which may have options as on the command line.
+type serveJob struct {
+	Command     string `json:"command"`
+	Destination string `json:"destination"`
+}
+
+// serveResult is what -serve replies to a job with. ExitCode is what cmd2s3
+// would have exited with, had it been run for the job.
+type serveResult struct {
+	ExitCode int    `json:"exit_code"`
+	Message  string `json:"message,omitempty"`
+	Location string `json:"location,omitempty"`
+	ETag     string `json:"etag,omitempty"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// server runs jobs for -serve, one after another on each connection, and
+// with one S3 client between them all, so that they share its credentials
+// and connections. It accepts connections on l.
+type server struct {
+	l       net.Listener
+	cmd     *exec.Cmd // what each job's command is run like
+	newDest func(s3url string) (destination, error)
+	upload  func(ctx context.Context, d destination, body io.Reader) (*manager.UploadOutput, error)
+
+	// These are -timeout, for each job, and -kill-timeout.
+	timeout, killTimeout time.Duration
+
+	jobs atomic.Int64 // numbers the jobs in the log
+	// slots has room for as many jobs as -serve-max-jobs allows to run
+	// at once, between all the connections.
+	slots chan struct{}
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	stopping bool
+}
+
+// serveFlags are the flags which -serve can be used with.
+var serveFlags = []string{
+	"serve", "serve-max-jobs", "config", "dump-config", "log-file", "no-color", "verbose", "redact-key", "error-fd",
+	"deadline", "shell", "workdir", "exec-env", "exec-clear-env", "timeout", "kill-timeout",
+	"content-type", "content-language", "website-redirect-location", "mime-types",
+	"auto-content-type", "metadata-from-env", "sse", "sse-kms-key-id", "sse-kms-key-alias",
+	"bucket-key-enabled", "strict-keys", "part-size", "concurrency", "profile-preset",
+	"disable-content-md5", "dualstack", "assume-role", "sts-regional-endpoint", "max-conns-per-host",
+	"max-idle-conns", "max-idle-conns-per-host", "idle-conn-timeout", "retry-base-delay",
+	"retry-jitter", "retry-max-delay",
+}
+
+// listenUnix listens on the unix socket at path, which only its owner may
+// connect to. A socket left there by a cmd2s3 which didn't exit cleanly is
+// replaced.
+func listenUnix(path string) (*net.UnixListener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return listenPrivate(path)
+}
+
+// serve accepts connections until stop is called, or ctx is done, which
+// also stops the jobs in progress. It then waits for them to finish.
+func (s *server) serve(ctx context.Context) error {
+	defer context.AfterFunc(ctx, s.stop)()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := s.l.Accept()
+		s.mu.Lock()
+		stopping := s.stopping
+		if err == nil && !stopping {
+			s.conns[conn] = true
+		}
+		s.mu.Unlock()
+		switch {
+		case stopping:
+			if conn != nil {
+				conn.Close()
+			}
+			return nil
+		case err != nil:
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(ctx, conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// stop stops accepting connections, and jobs on the ones there are, but
+// lets the jobs in progress finish.
+func (s *server) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return
+	}
+	s.stopping = true
+	for conn := range s.conns {
+		// Wake up the reads waiting for another job.
+		conn.SetReadDeadline(time.Now())
+	}
+	s.l.Close()
+}
+
+// isStopping reports whether stop has been called.
+func (s *server) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+// handle runs the jobs sent on conn, a line of JSON each, and replies to each
+// with a line of JSON, until conn is closed or the server is stopped.
+func (s *server) handle(ctx context.Context, conn net.Conn) {
+	sc := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	enc.SetEscapeHTML(false)
+	for !s.isStopping() && sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var job serveJob
+		var res serveResult
+		if err := json.Unmarshal(sc.Bytes(), &job); err != nil {
+			res = serveResult{ExitCode: exitUsage, Message: fmt.Sprintf("bad job: %v", err)}
+		} else {
+			res = s.runWhenFree(ctx, job)
+		}
+		if err := enc.Encode(res); err != nil {
+			warnf("-serve: replying: %v", err)
+			return
+		}
+	}
+	if err := sc.Err(); err != nil && !s.isStopping() {
+		warnf("-serve: %v", err)
+	}
+}
+
+// runWhenFree runs job once there's a slot for it. A job still waiting when
+// the server is stopped isn't run.
+func (s *server) runWhenFree(ctx context.Context, job serveJob) serveResult {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+	if s.isStopping() {
+		return serveResult{ExitCode: exitInterrupted, Message: "-serve is stopping"}
+	}
+	return s.run(ctx, s.jobs.Add(1), job)
+}
+
+// run runs job n.
+func (s *server) run(ctx context.Context, n int64, job serveJob) serveResult {
+	var counter *countingReader
+	fail := func(code int, format string, v ...any) serveResult {
+		msg := fmt.Sprintf(format, v...)
+		errorf("job %d: %s", n, msg)
+		res := serveResult{ExitCode: code, Message: msg}
+		if counter != nil {
+			res.Bytes = counter.n.Load()
+		}
+		return res
+	}
+	if strings.TrimSpace(job.Command) == "" {
+		return fail(exitUsage, "the shell command is empty")
+	}
+	d, err := s.newDest(job.Destination)
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := likeCommand(ctx, s.cmd, job.Command)
+	if s.killTimeout > 0 {
+		stopGently(c, s.killTimeout)
+	}
+	out, err := c.StdoutPipe()
+	if err == nil {
+		err = c.Start()
+	}
+	if err != nil {
+		return fail(exitCommandStart, "Invoking shell command %q: %v", job.Command, err)
+	}
+	debugf("job %d: running %q for %v", n, job.Command, d)
+
+	var waitErr error
+	counter = &countingReader{Reader: readWithWaitError(out, func() error {
+		waitErr = c.Wait()
+		return waitErr
+	})}
+	resp, err := s.upload(ctx, d, counter)
+	// cmdErr is set if the command failed, rather than being stopped
+	// because the upload did.
+	cmdErr := waitErr
+	if err != nil {
+		// Stop the command if it's still going, and wait for it.
+		cancel()
+		io.Copy(io.Discard, counter)
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fail(exitTimeout, "%v: timed out: %v", d, err)
+	case cmdErr != nil:
+		return fail(exitCommandFail, "%v: shell command failed after writing %d bytes: %v", d, counter.n.Load(), cmdErr)
+	case err != nil:
+		return fail(exitUploadFail, "%v: %s", d, describeError(err))
+	}
+	log.Printf("job %d: Object uploaded: %v - %d bytes", n, resp.Location, counter.n.Load())
+	res := serveResult{Location: resp.Location, Bytes: counter.n.Load()}
+	if resp.ETag != nil {
+		res.ETag = *resp.ETag
+	}
+	return res
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+// newTestServer returns a server on a socket in a temporary directory, which
+// runs up to maxJobs jobs at once with upload, and the socket's path.
+func newTestServer(t *testing.T, maxJobs int, upload func(ctx context.Context, d destination, body io.Reader) (*manager.UploadOutput, error)) (*server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sock")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return &server{
+		l:     l,
+		conns: map[net.Conn]bool{},
+		slots: make(chan struct{}, maxJobs),
+		cmd:   exec.Command("sh", "-c", ""),
+		newDest: func(s3url string) (destination, error) {
+			return destination{bucket: aws.String("bucket"), key: aws.String(s3url)}, nil
+		},
+		upload: upload,
+	}, path
+}
+
+func TestListenUnixMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows ignores the mode")
+	}
+	path := filepath.Join(t.TempDir(), "sock")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("the socket's mode is %v, want 0600", perm)
+	}
+}
+
+func TestServerStopBeforeServe(t *testing.T) {
+	s, _ := newTestServer(t, 1, nil)
+	// As a SIGTERM straight after starting does.
+	s.stop()
+	done := make(chan error)
+	go func() { done <- s.serve(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return once stopped")
+	}
+}
+
+func TestServeMaxJobs(t *testing.T) {
+	var running, most atomic.Int32
+	s, path := newTestServer(t, 1, func(ctx context.Context, d destination, body io.Reader) (*manager.UploadOutput, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(50 * time.Millisecond)
+		io.Copy(io.Discard, body)
+		return &manager.UploadOutput{Location: d.String()}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- s.serve(ctx) }()
+
+	var wg sync.WaitGroup
+	results := make([]serveResult, 3)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			json.NewEncoder(conn).Encode(serveJob{Command: "echo hello", Destination: "key"})
+			sc := bufio.NewScanner(conn)
+			if !sc.Scan() {
+				t.Errorf("no reply: %v", sc.Err())
+				return
+			}
+			if err := json.Unmarshal(sc.Bytes(), &results[i]); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+
+	for i, res := range results {
+		if res.ExitCode != exitOK || res.Bytes != int64(len("hello\n")) {
+			t.Errorf("job %d: %+v, want it uploaded", i, res)
+		}
+	}
+	if n := most.Load(); n != 1 {
+		t.Errorf("%d jobs ran at once, want at most 1", n)
+	}
+}
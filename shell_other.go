@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "os/exec"
+
+// defaultShell runs the command.
+const defaultShell = "sh -c"
+
+// setCommandLine sets the command line of c, a command run with a shell.
+// There's nothing to do: the shell gets its arguments as they are.
+func setCommandLine(c *exec.Cmd) {}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// defaultShell runs the command. Windows has no sh.
+const defaultShell = "cmd /C"
+
+// setCommandLine sets the command line of c, a command run with a shell,
+// whose last argument is the command. cmd.exe doesn't parse its command line
+// as Go quotes the arguments, e.g. "echo \"hi\"" for echo "hi", but takes
+// everything after /C as the command, so that's passed on as it is. Other
+// shells parse theirs as Go quotes it.
+func setCommandLine(c *exec.Cmd) {
+	name := strings.ToLower(filepath.Base(c.Path))
+	if name != "cmd.exe" && name != "cmd" {
+		return
+	}
+	args := make([]string, len(c.Args)-1)
+	for i, a := range c.Args[:len(c.Args)-1] {
+		args[i] = syscall.EscapeArg(a)
+	}
+	c.SysProcAttr = &syscall.SysProcAttr{CmdLine: strings.Join(append(args, c.Args[len(c.Args)-1]), " ")}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestSetCommandLine(t *testing.T) {
+	c := &exec.Cmd{Path: `C:\Windows\System32\cmd.exe`, Args: []string{"cmd", "/C", `echo "a b" & dir`}}
+	setCommandLine(c)
+	if c.SysProcAttr == nil || c.SysProcAttr.CmdLine != `cmd /C echo "a b" & dir` {
+		t.Errorf("command line %+v, want the command as it is after cmd /C", c.SysProcAttr)
+	}
+
+	c = &exec.Cmd{Path: `C:\Program Files\Git\bin\bash.exe`, Args: []string{"bash", "-c", `echo "a b"`}}
+	setCommandLine(c)
+	if c.SysProcAttr != nil {
+		t.Errorf("command line %q for bash, want Go's quoting", c.SysProcAttr.CmdLine)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// handleSignals shuts down in order on SIGINT or SIGTERM: interrupt is
+// called to stop the input, normally by passing the signal on to the
+// command, so that the upload sees its output end. Unless
+// -upload-partial-on-failure is given, the command failing then aborts the
+// upload, while the context is still live for the AbortMultipartUpload call.
+// A second signal exits straight away, with hardExit.
+//
+// The returned function reports the signal received, if any.
+func handleSignals(interrupt func(os.Signal)) (received func() os.Signal) {
+	var (
+		mu  sync.Mutex
+		got os.Signal
+	)
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	signalsHandled()
+	go func() {
+		for sig := range c {
+			mu.Lock()
+			first := got == nil
+			got = sig
+			mu.Unlock()
+			if !first {
+				errorf("received %v again, exiting now", sig)
+				hardExit(exitInterrupted)
+				continue
+			}
+			warnf("received %v, stopping the command and finishing up; send it again to exit now", sig)
+			interrupt(sig)
+		}
+	}()
+	return func() os.Signal {
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+}
+
+// signalsHandled is called once handleSignals is handling them. The tests
+// wait for it before sending one.
+var signalsHandled = func() {}
+
+// stopGently makes cancelling cmd's context, e.g. by -timeout, send it
+// SIGTERM rather than SIGKILL, and SIGKILL only if it's still running after
+// timeout.
+func stopGently(cmd *exec.Cmd, timeout time.Duration) {
+	cmd.Cancel = func() error {
+		warnf("sending the command SIGTERM; it's killed if it hasn't finished in %v", timeout)
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			// E.g. on Windows, which can only kill.
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = timeout
+}
+
+// killAfter kills cmd if it's still running after timeout, for when it's been
+// sent a signal which it may ignore.
+func killAfter(cmd *exec.Cmd, timeout time.Duration) {
+	time.AfterFunc(timeout, func() {
+		// Kill succeeds for a command which has exited but not been
+		// waited for yet, so it's once it has that stoppedBy tells
+		// which signal stopped it.
+		if cmd.Process.Kill() == nil {
+			debugf("Sent the command SIGKILL, %v after the signal", timeout)
+		}
+	})
+}
+
+// stoppedBy returns the signal which ended the process, if one did.
+func stoppedBy(ps *os.ProcessState) (os.Signal, bool) {
+	if ps == nil {
+		return nil, false
+	}
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return nil, false
+	}
+	return ws.Signal(), true
+}
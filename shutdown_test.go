@@ -0,0 +1,124 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sigtermWhen sends cmd2s3, which is this process, SIGTERM once it's
+// handling signals and the file started exists, as made by the command once
+// it's got as far as the test wants.
+func sigtermWhen(t *testing.T, started string) {
+	t.Helper()
+	// Until cmd2s3 handles it, SIGTERM would kill the test.
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGTERM)
+	handled := make(chan struct{})
+	var once sync.Once
+	signalsHandled = func() { once.Do(func() { close(handled) }) }
+	t.Cleanup(func() {
+		signalsHandled = func() {}
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+	})
+	go func() {
+		// The command may make the file before cmd2s3 handles
+		// signals.
+		<-handled
+		for {
+			if _, err := os.Stat(started); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+}
+
+func TestSignalDuringStartup(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	started := filepath.Join(t.TempDir(), "started")
+	sigtermWhen(t, started)
+	_, err := runCmd2s3(t, "s3://bucket/key", "touch "+started+"; exec sleep 10")
+	if code := exitCode(err); code != exitInterrupted {
+		t.Errorf("exit code %d (%v), want %d", code, err, exitInterrupted)
+	}
+	if _, err := s3.backend.HeadObject("bucket", "key"); err == nil {
+		t.Error("the object was created")
+	}
+}
+
+func TestSignalDuringUpload(t *testing.T) {
+	for _, partial := range []bool{false, true} {
+		name := "abort"
+		if partial {
+			name = "upload partial"
+		}
+		t.Run(name, func(t *testing.T) {
+			s3 := newFakeS3(t, "bucket")
+			started := filepath.Join(t.TempDir(), "started")
+			sigtermWhen(t, started)
+			args := []string{"-part-size", "5MiB"}
+			if partial {
+				args = append(args, "-upload-partial-on-failure")
+			}
+			// More than a part, so that the upload is multipart
+			// by the time the signal comes.
+			args = append(args, "s3://bucket/key", "head -c 6000000 /dev/zero; touch "+started+"; exec sleep 10")
+			_, err := runCmd2s3(t, args...)
+			if code := exitCode(err); code != exitInterrupted {
+				t.Errorf("exit code %d (%v), want %d", code, err, exitInterrupted)
+			}
+			if !s3.sent("POST /bucket/key?uploads") {
+				t.Fatal("no multipart upload was created")
+			}
+			if !partial {
+				if !s3.sent("DELETE /bucket/key?uploadId=") {
+					t.Error("the multipart upload wasn't aborted")
+				}
+				if _, err := s3.backend.HeadObject("bucket", "key"); err == nil {
+					t.Error("the object was created")
+				}
+				return
+			}
+			// gofakes3 takes the tagging for a PutObject, so the
+			// object can't be checked afterwards.
+			if !s3.sent("POST /bucket/key?uploadId=") || s3.sent("DELETE /bucket/key?uploadId=") {
+				t.Error("the multipart upload wasn't completed")
+			}
+			if !s3.sent("PUT /bucket/key?tagging") {
+				t.Error("the object wasn't tagged cmd2s3-command-failed")
+			}
+		})
+	}
+}
+
+func TestSignalKillTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"stops", "touch %s; exec sleep 10", "The command was stopped by a signal: terminated"},
+		// sleep inherits the ignored SIGTERM.
+		{"ignores SIGTERM", "trap '' TERM; touch %s; exec sleep 10", "The command was stopped by a signal: killed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newFakeS3(t, "bucket")
+			started := filepath.Join(t.TempDir(), "started")
+			sigtermWhen(t, started)
+			logged, _ := runCmd2s3(t, "-kill-timeout", "100ms", "s3://bucket/key", fmt.Sprintf(tc.command, started))
+			if !strings.Contains(logged, tc.want) {
+				t.Errorf("the log doesn't say %q:\n%s", tc.want, logged)
+			}
+		})
+	}
+}
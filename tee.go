@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// teeFile writes what's read through it to a local file, for -tee. The file
+// is closed at EOF, after an fsync if asked for.
+type teeFile struct {
+	r     io.Reader
+	f     *os.File
+	fsync bool
+	stop  func()
+}
+
+// newTeeFile creates filename and copies what's read from r to it. If
+// interval is positive, the file is also synced that often.
+func newTeeFile(r io.Reader, filename string, fsync bool, interval time.Duration) (*teeFile, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	t := &teeFile{r: io.TeeReader(r, f), f: f, fsync: fsync, stop: func() {}}
+	if interval > 0 {
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tick := time.NewTicker(interval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-tick.C:
+					if err := f.Sync(); err != nil {
+						warnf("-tee: %v", err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		t.stop = func() {
+			close(done)
+			wg.Wait()
+		}
+	}
+	return t, nil
+}
+
+func (t *teeFile) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err == io.EOF {
+		if cerr := t.close(); cerr != nil {
+			err = fmt.Errorf("-tee: %v", cerr)
+		}
+	}
+	return n, err
+}
+
+// close syncs and closes the file, once.
+func (t *teeFile) close() error {
+	if t.f == nil {
+		return nil
+	}
+	f := t.f
+	t.f = nil
+	t.stop()
+	if t.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
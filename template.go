@@ -0,0 +1,61 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"math/rand/v2"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// keyData is what -template-keys templates can refer to.
+type keyData struct {
+	// CommandHash is the first 16 hex digits of the SHA-256 of the shell
+	// command, so that identical jobs get identical keys.
+	CommandHash string
+	// Now is when cmd2s3 started, in UTC. Use e.g.
+	// {{.Now.Format "2006-01-02"}}.
+	Now time.Time
+	// Rand is 16 random characters, the same for every key of a run, so
+	// that concurrent runs get different keys. It's what -unique-suffix
+	// appends.
+	Rand string
+}
+
+func newKeyData(command string, now time.Time, rand string) keyData {
+	sum := sha256.Sum256([]byte(command))
+	return keyData{
+		CommandHash: hex.EncodeToString(sum[:])[:16],
+		Now:         now.UTC(),
+		Rand:        rand,
+	}
+}
+
+// randSuffix returns 80 random bits as 16 lowercase base32 characters. If
+// seed isn't 0 they come from seed, and are the same each time.
+func randSuffix(seed uint64) string {
+	b := make([]byte, 10)
+	if seed == 0 {
+		crand.Read(b)
+	} else {
+		r := rand.New(rand.NewPCG(seed, 0))
+		for i := range b {
+			b[i] = byte(r.Uint32())
+		}
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+// expandKey executes key as a text/template with data.
+func expandKey(key string, data keyData) (string, error) {
+	t, err := template.New("key").Option("missingkey=error").Parse(key)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = t.Execute(&b, data)
+	return b.String(), err
+}
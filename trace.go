@@ -0,0 +1,8 @@
+package main
+
+// spanAttrs are what's recorded about an upload or command when tracing is
+// built in with the otel build tag.
+type spanAttrs struct {
+	bucket, key  string
+	bytes, parts int64
+}
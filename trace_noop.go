@@ -0,0 +1,13 @@
+//go:build !otel
+
+package main
+
+import "context"
+
+// startTracing does nothing without the otel build tag.
+func startTracing(ctx context.Context) context.Context { return ctx }
+
+// startSpan does nothing without the otel build tag.
+func startSpan(ctx context.Context, name string) (context.Context, func(spanAttrs, error)) {
+	return ctx, func(spanAttrs, error) {}
+}
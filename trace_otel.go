@@ -0,0 +1,81 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is set by startTracing.
+var tracer trace.Tracer
+
+// startTracing exports spans with OTLP over HTTP, configured by the usual
+// OTEL_* environment variables, and starts a span for the whole run, which
+// ends on exit. The span's parent is taken from TRACEPARENT, if it's set.
+func startTracing(ctx context.Context) context.Context {
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		warnf("otel: %v", err)
+		return ctx
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "cmd2s3")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		warnf("otel: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	tracer = tp.Tracer("github.com/sensiblecodeio/cmd2s3")
+
+	ctx = propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{
+		"traceparent": os.Getenv("TRACEPARENT"),
+		"tracestate":  os.Getenv("TRACESTATE"),
+	})
+	ctx, span := tracer.Start(ctx, "cmd2s3")
+	atExit(func(code int) {
+		span.SetAttributes(attribute.Int("cmd2s3.exit_code", code))
+		if code != exitOK {
+			span.SetStatus(codes.Error, lastError)
+		}
+		span.End()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			warnf("otel: %v", err)
+		}
+	})
+	return ctx
+}
+
+// startSpan starts a span called name, and returns a function to end it.
+func startSpan(ctx context.Context, name string) (context.Context, func(spanAttrs, error)) {
+	if tracer == nil {
+		return ctx, func(spanAttrs, error) {}
+	}
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, func(a spanAttrs, err error) {
+		if a.bucket != "" {
+			span.SetAttributes(attribute.String("aws.s3.bucket", a.bucket), attribute.String("aws.s3.key", a.key))
+		}
+		span.SetAttributes(attribute.Int64("cmd2s3.bytes", a.bytes))
+		if a.parts > 0 {
+			span.SetAttributes(attribute.Int64("cmd2s3.parts", a.parts))
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
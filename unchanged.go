@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// sha256MetaKey is the user metadata, x-amz-meta-sha256, which
+// -skip-if-unchanged stores the SHA-256 of the object in.
+const sha256MetaKey = "sha256"
+
+// spool copies r to a temporary file, and returns it, positioned at the
+// start, with the hex SHA-256 of its content. The caller removes the file.
+func spool(r io.Reader) (*os.File, string, error) {
+	f, err := os.CreateTemp("", "cmd2s3-spool-*")
+	if err != nil {
+		return nil, "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	return f, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// unchanged reports whether the object at d exists and has sum in its
+// x-amz-meta-sha256.
+func unchanged(ctx context.Context, svc *s3.Client, d destination, sum string) (bool, error) {
+	head, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: d.bucket,
+		Key:    d.key,
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return head.Metadata[sha256MetaKey] == sum, nil
+}
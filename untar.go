@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// runUntar downloads the tar archive at d and extracts it into dir, which is
+// created if need be, decompressing it first if gunzip is set. Entries whose
+// names would land outside dir are an error, and symlinks can't be followed
+// out of it either. It returns how many entries were extracted, and on
+// failure the exit code to use.
+func runUntar(ctx context.Context, svc *s3.Client, d destination, dir string, gunzip bool) (int, int, error) {
+	obj, err := svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: d.bucket,
+		Key:    d.key,
+	})
+	if err != nil {
+		return 0, exitUploadFail, err
+	}
+	defer obj.Body.Close()
+
+	var body io.Reader = obj.Body
+	if gunzip {
+		body, err = newGunzipReader(body)
+		if err != nil {
+			return 0, exitCorruptGzip, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, exitError, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return 0, exitError, err
+	}
+	defer root.Close()
+
+	n := 0
+	tr := tar.NewReader(body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, exitOK, nil
+		}
+		if err == nil {
+			err = extractEntry(root, hdr, tr)
+		}
+		var gzErr corruptGzipError
+		switch {
+		case errors.As(err, &gzErr):
+			return n, exitCorruptGzip, err
+		case err != nil:
+			return n, exitError, err
+		}
+		n++
+	}
+}
+
+// extractEntry creates the file, directory or link hdr describes in root.
+func extractEntry(root *os.Root, hdr *tar.Header, r io.Reader) error {
+	name := filepath.Clean(filepath.FromSlash(hdr.Name))
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("%q: not a relative path within the directory", hdr.Name)
+	}
+	mode := hdr.FileInfo().Mode().Perm()
+	if dir := filepath.Dir(name); dir != "." {
+		if err := root.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return root.MkdirAll(name, mode|0o700)
+	case tar.TypeReg:
+		f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %w", hdr.Name, err)
+		}
+		return root.Chtimes(name, hdr.AccessTime, hdr.ModTime)
+	case tar.TypeSymlink:
+		return root.Symlink(hdr.Linkname, name)
+	case tar.TypeLink:
+		target := filepath.Clean(filepath.FromSlash(hdr.Linkname))
+		if !filepath.IsLocal(target) {
+			return fmt.Errorf("%q: links to %q, outside the directory", hdr.Name, hdr.Linkname)
+		}
+		return root.Link(target, name)
+	default:
+		warnf("skipping %q, of tar type %q", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// urlFormats are the choices of -print-url-format.
+var urlFormats = []string{"virtual", "path", "console"}
+
+// objectURL returns a URL for d in one of urlFormats: virtual-hosted-style
+// (https://bucket.s3.region.amazonaws.com/key), path-style
+// (https://s3.region.amazonaws.com/bucket/key) or the object's page in the
+// AWS console. endpoint is a custom S3 endpoint, if any.
+func objectURL(format string, d destination, region, endpoint string, dualStack bool) (string, error) {
+	if arn.IsARN(*d.bucket) {
+		return "", errors.New("there's no such URL for an access point")
+	}
+	if format == "console" {
+		if endpoint != "" {
+			return "", errors.New("there's no console URL for a custom endpoint")
+		}
+		console := "https://s3.console.aws.amazon.com"
+		switch {
+		case strings.HasPrefix(region, "cn-"):
+			console = "https://console.amazonaws.cn"
+		case strings.HasPrefix(region, "us-gov-"):
+			console = "https://console.amazonaws-us-gov.com"
+		}
+		q := url.Values{"region": {region}, "prefix": {*d.key}}
+		return console + "/s3/object/" + url.PathEscape(*d.bucket) + "?" + q.Encode(), nil
+	}
+
+	var u *url.URL
+	if endpoint != "" {
+		var err error
+		u, err = url.Parse(endpoint)
+		if err != nil {
+			return "", fmt.Errorf("endpoint: %v", err)
+		}
+	} else {
+		if region == "" {
+			return "", errors.New("no region is set")
+		}
+		host := "s3." + region + ".amazonaws.com"
+		if dualStack {
+			host = "s3.dualstack." + region + ".amazonaws.com"
+		}
+		if strings.HasPrefix(region, "cn-") {
+			host += ".cn"
+		}
+		u = &url.URL{Scheme: "https", Host: host}
+	}
+
+	key := escapeKey(*d.key)
+	if format == "virtual" {
+		u.Host = *d.bucket + "." + u.Host
+	} else {
+		key = url.PathEscape(*d.bucket) + "/" + key
+	}
+	return strings.TrimSuffix(u.String(), "/") + "/" + key, nil
+}
+
+// escapeKey escapes key for a URL path, keeping its slashes. S3 reads a +
+// in the path as a space, so that's escaped too.
+func escapeKey(key string) string {
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		segs[i] = strings.ReplaceAll(url.PathEscape(s), "+", "%2B")
+	}
+	return strings.Join(segs, "/")
+}